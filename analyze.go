@@ -0,0 +1,416 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"sort"
+	"time"
+)
+
+const (
+	PCAP_MAGIC_NANOSECONDS = 0xA1B23C4D
+
+	LINKTYPE_ETHERNET  = 1
+	LINKTYPE_LINUX_SLL = 113
+	LINKTYPE_IPV4      = 228
+	LINKTYPE_IPV6      = 229
+
+	LINUX_SLL_HEADER_LENGTH = 16
+
+	// The largest record we'll read, whatever the file's snapshot length says;
+	// this is the largest snaplen tcpdump uses
+	PCAP_MAX_RECORD_LENGTH = 262144
+)
+
+var ErrInvalidPcap = fmt.Errorf("not a pcap file")
+var ErrPcapRecordTooLong = fmt.Errorf("pcap record longer than the snapshot length")
+
+// pcapReader reads packets from a libpcap file written by any capture tool,
+// not just ours: either byte order, and micro- or nanosecond timestamps.
+type pcapReader struct {
+	r           *bufio.Reader
+	order       binary.ByteOrder
+	nanoseconds bool
+	LinkType    uint32
+
+	// The longest record the file can contain
+	SnapLength uint32
+}
+
+func newPcapReader(r io.Reader) (*pcapReader, error) {
+	p := &pcapReader{r: bufio.NewReader(r)}
+
+	header := make([]byte, PCAP_HEADER_LENGTH)
+	if _, err := io.ReadFull(p.r, header); err != nil {
+		return nil, ErrInvalidPcap
+	}
+
+	switch {
+	case binary.LittleEndian.Uint32(header) == PCAP_MAGIC_MICROSECONDS:
+		p.order = binary.LittleEndian
+	case binary.BigEndian.Uint32(header) == PCAP_MAGIC_MICROSECONDS:
+		p.order = binary.BigEndian
+	case binary.LittleEndian.Uint32(header) == PCAP_MAGIC_NANOSECONDS:
+		p.order, p.nanoseconds = binary.LittleEndian, true
+	case binary.BigEndian.Uint32(header) == PCAP_MAGIC_NANOSECONDS:
+		p.order, p.nanoseconds = binary.BigEndian, true
+	default:
+		return nil, ErrInvalidPcap
+	}
+
+	p.SnapLength = p.order.Uint32(header[16:])
+	if p.SnapLength == 0 || p.SnapLength > PCAP_MAX_RECORD_LENGTH {
+		p.SnapLength = PCAP_MAX_RECORD_LENGTH
+	}
+
+	p.LinkType = p.order.Uint32(header[20:])
+	return p, nil
+}
+
+// Next returns the next packet and when it was captured, or io.EOF. If the
+// capture cut the packet short, it's padded with zeros back to its original
+// length and truncated is set: the headers are all that's needed, and the
+// lengths in them then still agree with the packet.
+func (p *pcapReader) Next() (data []byte, truncated bool, timestamp time.Time, err error) {
+	record := make([]byte, PCAP_RECORD_HEADER_LENGTH)
+	if _, err = io.ReadFull(p.r, record); err != nil {
+		return
+	}
+
+	fraction := time.Duration(p.order.Uint32(record[4:]))
+	if !p.nanoseconds {
+		fraction *= time.Microsecond
+	}
+	timestamp = time.Unix(int64(p.order.Uint32(record[0:])), int64(fraction))
+
+	captured, original := p.order.Uint32(record[8:]), p.order.Uint32(record[12:])
+	if captured > p.SnapLength {
+		err = ErrPcapRecordTooLong
+		return
+	}
+
+	data = make([]byte, captured)
+	if _, err = io.ReadFull(p.r, data); err != nil {
+		err = io.ErrUnexpectedEOF
+		return
+	}
+
+	if original > captured {
+		if original > PCAP_MAX_RECORD_LENGTH {
+			original = PCAP_MAX_RECORD_LENGTH
+		}
+		data = append(data, make([]byte, original-captured)...)
+		truncated = true
+	}
+	return
+}
+
+// ipPacket strips the link-layer header, if the link type has one.
+func (p *pcapReader) ipPacket(data []byte) ([]byte, bool) {
+	switch p.LinkType {
+	case LINKTYPE_RAW, LINKTYPE_IPV4, LINKTYPE_IPV6:
+		return data, true
+
+	case LINKTYPE_ETHERNET:
+		reader := bytes.NewReader(data)
+		eth, err := parseEthernetHeader(reader)
+		if err != nil || (eth.EtherType != ETHERTYPE_IPV4 && eth.EtherType != ETHERTYPE_IPV6) {
+			return nil, false
+		}
+		return data[ETHERNET_HEADER_LENGTH:], true
+
+	case LINKTYPE_LINUX_SLL:
+		if len(data) < LINUX_SLL_HEADER_LENGTH {
+			return nil, false
+		}
+		etherType := binary.BigEndian.Uint16(data[14:])
+		if etherType != ETHERTYPE_IPV4 && etherType != ETHERTYPE_IPV6 {
+			return nil, false
+		}
+		return data[LINUX_SLL_HEADER_LENGTH:], true
+	}
+
+	return nil, false
+}
+
+// flowDirection tracks one side of a flow: the segments sent from Source.
+type flowDirection struct {
+	Source, Destination netip.AddrPort
+
+	Packets, Bytes                                   int
+	Retransmissions, OutOfOrder, ZeroWindows, Resets int
+
+	// The sequence number after the highest segment seen so far, and the
+	// sequence numbers of the segments seen before it
+	haveSeq bool
+	highest SeqNum
+	seen    map[SeqNum]bool
+}
+
+func (d *flowDirection) add(tcp *TCP, payloadLength int) {
+	d.Packets++
+	d.Bytes += payloadLength
+
+	if tcp.ControlBits&0x04 == 0x04 {
+		d.Resets++
+		return
+	}
+
+	if tcp.Window == 0 {
+		d.ZeroWindows++
+	}
+
+	seq := SeqNum(tcp.SequenceNumber)
+	length := uint32(payloadLength)
+	if tcp.ControlBits&0x02 == 0x02 {
+		length++
+	}
+	if tcp.ControlBits&0x01 == 0x01 {
+		length++
+	}
+
+	// Bare ACKs don't occupy sequence space
+	if length == 0 {
+		return
+	}
+
+	if !d.haveSeq {
+		d.haveSeq = true
+		d.highest = seq
+		d.seen = make(map[SeqNum]bool)
+	}
+
+	if seq.LessThan(d.highest) {
+		// Behind the highest segment: either we've seen it before, or it was
+		// overtaken by a later one
+		if d.seen[seq] {
+			d.Retransmissions++
+		} else {
+			d.OutOfOrder++
+		}
+	}
+
+	d.seen[seq] = true
+	if end := seq.Add(length); end.GreaterThan(d.highest) {
+		d.highest = end
+	}
+}
+
+type flowKey struct {
+	A, B netip.AddrPort
+}
+
+// flow is a TCP connection reconstructed from a capture. Client is whoever
+// sent the first segment seen, normally the SYN.
+type flow struct {
+	Client, Server flowDirection
+	First, Last    time.Time
+
+	SynTime, SynAckTime, AckTime time.Time
+}
+
+func newFlowKey(source, destination netip.AddrPort) flowKey {
+	if destination.Addr().Less(source.Addr()) || (destination.Addr() == source.Addr() && destination.Port() < source.Port()) {
+		return flowKey{destination, source}
+	}
+	return flowKey{source, destination}
+}
+
+func (f *flow) add(source netip.AddrPort, tcp *TCP, payloadLength int, now time.Time) {
+	f.Last = now
+
+	syn := tcp.ControlBits&0x02 == 0x02
+	ack := tcp.ControlBits&0x10 == 0x10
+
+	d := &f.Client
+	if source != f.Client.Source {
+		d = &f.Server
+	}
+
+	switch {
+	case syn && !ack && d == &f.Client && f.SynTime.IsZero():
+		f.SynTime = now
+	case syn && ack && d == &f.Server && f.SynAckTime.IsZero():
+		f.SynAckTime = now
+	case !syn && ack && d == &f.Client && !f.SynAckTime.IsZero() && f.AckTime.IsZero():
+		f.AckTime = now
+	}
+
+	d.add(tcp, payloadLength)
+}
+
+func (f *flow) Report() {
+	fmt.Printf("%s <-> %s: %d packets over %s\n", f.Client.Source, f.Client.Destination,
+		f.Client.Packets+f.Server.Packets, f.Last.Sub(f.First))
+
+	switch {
+	case f.SynTime.IsZero():
+		fmt.Printf("  handshake: not captured\n")
+	case f.SynAckTime.IsZero():
+		fmt.Printf("  handshake: SYN unanswered\n")
+	case f.AckTime.IsZero():
+		fmt.Printf("  handshake: SYN -> SYN-ACK %s, no final ACK\n", f.SynAckTime.Sub(f.SynTime))
+	default:
+		fmt.Printf("  handshake: SYN -> SYN-ACK %s, SYN-ACK -> ACK %s, total %s\n",
+			f.SynAckTime.Sub(f.SynTime), f.AckTime.Sub(f.SynAckTime), f.AckTime.Sub(f.SynTime))
+	}
+
+	for _, d := range []*flowDirection{&f.Client, &f.Server} {
+		if d.Packets == 0 {
+			continue
+		}
+		fmt.Printf("  %s -> %s: %d packets, %d bytes, %d retransmissions, %d out of order, %d zero windows, %d resets\n",
+			d.Source, d.Destination, d.Packets, d.Bytes, d.Retransmissions, d.OutOfOrder, d.ZeroWindows, d.Resets)
+	}
+}
+
+// analyze decodes every TCP segment in a capture with the stack's own parsers
+// and reports on each flow. If verbose is set, every header is printed too.
+func analyze(r io.Reader, verbose bool) error {
+	pcap, err := newPcapReader(r)
+	if err != nil {
+		return err
+	}
+
+	flows := make(map[flowKey]*flow)
+	order := []flowKey{}
+	reassembler := NewReassembler(REASSEMBLY_MAX_MEMORY, REASSEMBLY_TIMEOUT)
+	skipped, truncated := 0, 0
+
+	for {
+		data, short, timestamp, err := pcap.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if short {
+			truncated++
+		}
+
+		packet, ok := pcap.ipPacket(data)
+		if !ok || len(packet) == 0 {
+			skipped++
+			continue
+		}
+
+		var source, destination netip.Addr
+		var segment []byte
+
+		if packet[0]>>4 == 6 {
+			reader := bytes.NewReader(packet)
+			ip, err := parseIPv6Header(reader)
+			if err != nil || ip.Protocol != 6 {
+				skipped++
+				continue
+			}
+			if verbose {
+				ip.Inspect()
+			}
+
+			end := IPV6_HEADER_LENGTH + int(ip.PayloadLength)
+			start := len(packet) - reader.Len()
+			if start > end || end > len(packet) {
+				skipped++
+				continue
+			}
+
+			source, destination = ip.SourceAddress, ip.DestinationAddress
+			segment = packet[start:end]
+		} else {
+			ip, err := parseIPHeader(bytes.NewReader(packet))
+			if err != nil {
+				skipped++
+				continue
+			}
+			if verbose {
+				ip.Inspect()
+			}
+
+			packet = packet[:ip.TotalLength]
+			segment = packet[int(ip.HeaderLength)*4:]
+
+			if ip.IsFragment() {
+				var complete bool
+				ip, segment, complete, err = reassembler.Add(ip, segment, timestamp)
+				if err != nil || !complete {
+					continue
+				}
+			}
+
+			if ip.Protocol != 6 {
+				skipped++
+				continue
+			}
+			source, destination = addrFromUint32(ip.SourceAddress), addrFromUint32(ip.DestinationAddress)
+		}
+
+		reader := bytes.NewReader(segment)
+		tcp, err := parseTCPHeader(reader)
+		if err != nil {
+			skipped++
+			continue
+		}
+		if verbose {
+			tcp.Inspect()
+		}
+
+		from := netip.AddrPortFrom(source, tcp.SourcePort)
+		to := netip.AddrPortFrom(destination, tcp.DestinationPort)
+
+		key := newFlowKey(from, to)
+		f, ok := flows[key]
+		if !ok {
+			f = &flow{First: timestamp}
+			f.Client.Source, f.Client.Destination = from, to
+			f.Server.Source, f.Server.Destination = to, from
+			flows[key] = f
+			order = append(order, key)
+		}
+
+		f.add(from, &tcp, reader.Len(), timestamp)
+	}
+
+	sort.SliceStable(order, func(i, j int) bool { return flows[order[i]].First.Before(flows[order[j]].First) })
+
+	fmt.Printf("%d flows (%d packets skipped, %d truncated by the snapshot length):\n", len(flows), skipped, truncated)
+	for _, key := range order {
+		flows[key].Report()
+	}
+
+	return nil
+}
+
+// analyzeCommand implements "tcp analyze [-v] <file.pcap>".
+func analyzeCommand(args []string) {
+	flags := flag.NewFlagSet("analyze", flag.ExitOnError)
+	verbose := flags.Bool("v", false, "print every IP and TCP header")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "usage: %s analyze [-v] <file.pcap>\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	file, err := os.Open(flags.Arg(0))
+	if err != nil {
+		fatal(parseLog, "failed to open capture", "err", err)
+	}
+	defer file.Close()
+
+	err = analyze(file, *verbose)
+	if err != nil {
+		fatal(parseLog, "failed to analyze capture", "path", flags.Arg(0), "err", err)
+	}
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	ARP_REQUEST = 1
+	ARP_REPLY   = 2
+
+	ARP_HARDWARE_ETHERNET = 1
+	ARP_LENGTH            = 28
+
+	// How long a resolved address is trusted before it has to be resolved again
+	ARP_CACHE_TIMEOUT = 60 * time.Second
+
+	// An unanswered request is repeated this often, this many times, before
+	// the packets waiting on it are dropped
+	ARP_REQUEST_INTERVAL = 1 * time.Second
+	ARP_REQUEST_RETRIES  = 3
+
+	// Packets held per unresolved address (RFC 1122 §2.3.2.2 asks for at least one)
+	ARP_QUEUE_LENGTH = 8
+)
+
+var ErrInvalidARP = fmt.Errorf("failed to parse ARP packet")
+
+type ARP struct {
+	HardwareType, ProtocolType                   uint16
+	HardwareLength, ProtocolLength               uint8
+	Operation                                    uint16
+	SenderHardwareAddress, TargetHardwareAddress net.HardwareAddr
+	SenderProtocolAddress, TargetProtocolAddress uint32
+}
+
+func parseARP(buf *bytes.Reader) (arp ARP, err error) {
+	/*
+	    0                   1                   2                   3
+	    0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1
+	   +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+	   |         Hardware Type         |         Protocol Type         |
+	   +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+	   |  HW Length    | Proto Length  |           Operation           |
+	   +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+	   |      Sender hardware address, sender protocol address,       |
+	   |      target hardware address, target protocol address        |
+	   +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+	**/
+
+	if buf.Len() < ARP_LENGTH {
+		return arp, ErrInvalidARP
+	}
+
+	binary.Read(buf, binary.BigEndian, &arp.HardwareType)
+	binary.Read(buf, binary.BigEndian, &arp.ProtocolType)
+	arp.HardwareLength, _ = buf.ReadByte()
+	arp.ProtocolLength, _ = buf.ReadByte()
+	binary.Read(buf, binary.BigEndian, &arp.Operation)
+
+	// Only Ethernet and IPv4 addresses are supported
+	if arp.HardwareType != ARP_HARDWARE_ETHERNET || arp.ProtocolType != ETHERTYPE_IPV4 || arp.HardwareLength != 6 || arp.ProtocolLength != 4 {
+		return arp, ErrInvalidARP
+	}
+
+	arp.SenderHardwareAddress = make(net.HardwareAddr, 6)
+	io.ReadFull(buf, arp.SenderHardwareAddress)
+	binary.Read(buf, binary.BigEndian, &arp.SenderProtocolAddress)
+
+	arp.TargetHardwareAddress = make(net.HardwareAddr, 6)
+	io.ReadFull(buf, arp.TargetHardwareAddress)
+	err = binary.Read(buf, binary.BigEndian, &arp.TargetProtocolAddress)
+	return
+}
+
+func (arp *ARP) Serialize() *bytes.Buffer {
+	buf := bytes.NewBuffer([]byte{})
+
+	binary.Write(buf, binary.BigEndian, arp.HardwareType)
+	binary.Write(buf, binary.BigEndian, arp.ProtocolType)
+	buf.WriteByte(arp.HardwareLength)
+	buf.WriteByte(arp.ProtocolLength)
+	binary.Write(buf, binary.BigEndian, arp.Operation)
+	buf.Write(arp.SenderHardwareAddress)
+	binary.Write(buf, binary.BigEndian, arp.SenderProtocolAddress)
+	buf.Write(arp.TargetHardwareAddress)
+	binary.Write(buf, binary.BigEndian, arp.TargetProtocolAddress)
+
+	return buf
+}
+
+type arpEntry struct {
+	HardwareAddress net.HardwareAddr
+	Expires         time.Time
+}
+
+// arpPending is an address we've sent a request for, and the packets waiting
+// to be sent to it.
+type arpPending struct {
+	queue       [][]byte
+	requests    int
+	nextRequest time.Time
+}
+
+// ARPCache maps IPv4 addresses to Ethernet addresses.
+type ARPCache struct {
+	mu      sync.Mutex
+	entries map[uint32]arpEntry
+	pending map[uint32]*arpPending
+}
+
+func NewARPCache() *ARPCache {
+	return &ARPCache{
+		entries: make(map[uint32]arpEntry),
+		pending: make(map[uint32]*arpPending),
+	}
+}
+
+// Lookup returns the Ethernet address for addr, or nil if it isn't known.
+func (a *ARPCache) Lookup(addr uint32, now time.Time) net.HardwareAddr {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	entry, ok := a.entries[addr]
+	if !ok {
+		return nil
+	}
+
+	if now.After(entry.Expires) {
+		delete(a.entries, addr)
+		return nil
+	}
+
+	return entry.HardwareAddress
+}
+
+// Update records addr's Ethernet address, returning any packets that were
+// waiting for it. If add is false, only an existing entry is refreshed, as
+// in RFC 826's merge step.
+func (a *ARPCache) Update(addr uint32, hw net.HardwareAddr, add bool, now time.Time) (queued [][]byte) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	_, known := a.entries[addr]
+	pending, waiting := a.pending[addr]
+	if !add && !known && !waiting {
+		return nil
+	}
+
+	a.entries[addr] = arpEntry{HardwareAddress: hw, Expires: now.Add(ARP_CACHE_TIMEOUT)}
+
+	if waiting {
+		delete(a.pending, addr)
+		return pending.queue
+	}
+	return nil
+}
+
+// Queue holds a packet until addr is resolved. It returns true if a request
+// should be sent now, i.e. this is the first packet waiting on addr.
+func (a *ARPCache) Queue(addr uint32, packet []byte, now time.Time) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	pending, ok := a.pending[addr]
+	if !ok {
+		pending = &arpPending{requests: 1, nextRequest: now.Add(ARP_REQUEST_INTERVAL)}
+		a.pending[addr] = pending
+	}
+
+	if len(pending.queue) >= ARP_QUEUE_LENGTH {
+		// Keep the most recent packets
+		pending.queue = pending.queue[1:]
+		drops.Add(linkLog, "ARP queue full", "addr", addrFromUint32(addr))
+	}
+	pending.queue = append(pending.queue, append([]byte{}, packet...))
+
+	return !ok
+}
+
+// Tick returns the addresses that need another request, and drops the packets
+// waiting on addresses that have run out of retries.
+func (a *ARPCache) Tick(now time.Time) (retry []uint32) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	for addr, pending := range a.pending {
+		if now.Before(pending.nextRequest) {
+			continue
+		}
+
+		if pending.requests >= ARP_REQUEST_RETRIES {
+			for range pending.queue {
+				drops.Add(linkLog, "ARP resolution timeout", "addr", addrFromUint32(addr))
+			}
+			delete(a.pending, addr)
+			continue
+		}
+
+		pending.requests++
+		pending.nextRequest = now.Add(ARP_REQUEST_INTERVAL)
+		retry = append(retry, addr)
+	}
+
+	return
+}
+
+func (a *ARPCache) Inspect() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	addrs := make([]int, 0, len(a.entries))
+	for addr := range a.entries {
+		addrs = append(addrs, int(addr))
+	}
+	sort.Ints(addrs)
+
+	fmt.Printf("%d ARP entries:\n", len(addrs))
+	for _, addr := range addrs {
+		entry := a.entries[uint32(addr)]
+		fmt.Printf("%s: %s (expires %s)\n", formatIPAddress(uint32(addr)), entry.HardwareAddress, entry.Expires.Format(time.StampMilli))
+	}
+
+	for addr, pending := range a.pending {
+		fmt.Printf("%s: incomplete (%d requests, %d packets queued)\n", formatIPAddress(addr), pending.requests, len(pending.queue))
+	}
+}
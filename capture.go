@@ -0,0 +1,355 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	PCAP_MAGIC_MICROSECONDS = 0xA1B2C3D4
+	PCAP_VERSION_MAJOR      = 2
+	PCAP_VERSION_MINOR      = 4
+	PCAP_SNAPLEN            = 65535
+
+	// Raw IPv4 or IPv6 packets with no link-layer header
+	LINKTYPE_RAW = 101
+
+	PCAP_HEADER_LENGTH        = 24
+	PCAP_RECORD_HEADER_LENGTH = 16
+)
+
+var ErrInvalidCaptureFilter = fmt.Errorf("invalid capture filter")
+
+// packetInfo is what a capture filter can match on. Ports are only set for
+// TCP and UDP packets that aren't later fragments.
+type packetInfo struct {
+	Source, Destination         netip.Addr
+	Protocol                    uint8
+	SourcePort, DestinationPort uint16
+	HasPorts                    bool
+}
+
+// parsePacketInfo pulls the addresses and ports out of a raw IPv4 or IPv6
+// packet without validating it.
+func parsePacketInfo(packet []byte) (info packetInfo, ok bool) {
+	var transport []byte
+
+	switch {
+	case len(packet) >= IP_MIN_HEADER_LENGTH*4 && packet[0]>>4 == 4:
+		headerLength := int(packet[0]&0x0F) * 4
+		info.Source = addrFromUint32(binary.BigEndian.Uint32(packet[12:]))
+		info.Destination = addrFromUint32(binary.BigEndian.Uint32(packet[16:]))
+		info.Protocol = packet[9]
+
+		fragmentOffset := binary.BigEndian.Uint16(packet[6:]) & 0x1FFF
+		if fragmentOffset == 0 && headerLength <= len(packet) {
+			transport = packet[headerLength:]
+		}
+
+	case len(packet) >= IPV6_HEADER_LENGTH && packet[0]>>4 == 6:
+		var source, destination [16]byte
+		copy(source[:], packet[8:24])
+		copy(destination[:], packet[24:40])
+		info.Source, info.Destination = netip.AddrFrom16(source), netip.AddrFrom16(destination)
+
+		reader := bytes.NewReader(packet[IPV6_HEADER_LENGTH:])
+		protocol, err := skipExtensionHeaders(reader, packet[6])
+		info.Protocol = protocol
+		if err == nil {
+			transport = packet[len(packet)-reader.Len():]
+		}
+
+	default:
+		return info, false
+	}
+
+	if (info.Protocol == 6 || info.Protocol == 17) && len(transport) >= 4 {
+		info.SourcePort = binary.BigEndian.Uint16(transport[0:])
+		info.DestinationPort = binary.BigEndian.Uint16(transport[2:])
+		info.HasPorts = true
+	}
+
+	return info, true
+}
+
+// CaptureFilter selects which packets are captured. Every term that's set has
+// to match, in either direction. It understands a small subset of tcpdump's
+// syntax: "host <addr>", "port <port>" and "quad <addr:port> <addr:port>",
+// optionally joined with "and".
+type CaptureFilter struct {
+	Host netip.Addr
+	Port uint16
+	Quad [2]netip.AddrPort
+
+	expression string
+}
+
+func parseCaptureFilter(words []string) (f CaptureFilter, err error) {
+	for i := 0; i < len(words); i++ {
+		switch words[i] {
+		case "and":
+			continue
+
+		case "host":
+			if i+1 >= len(words) {
+				return f, ErrInvalidCaptureFilter
+			}
+			i++
+			f.Host, err = netip.ParseAddr(words[i])
+
+		case "port":
+			if i+1 >= len(words) {
+				return f, ErrInvalidCaptureFilter
+			}
+			i++
+			var port uint64
+			port, err = strconv.ParseUint(words[i], 10, 16)
+			f.Port = uint16(port)
+
+		case "quad":
+			if i+2 >= len(words) {
+				return f, ErrInvalidCaptureFilter
+			}
+			f.Quad[0], err = netip.ParseAddrPort(words[i+1])
+			if err == nil {
+				f.Quad[1], err = netip.ParseAddrPort(words[i+2])
+			}
+			i += 2
+
+		default:
+			return f, ErrInvalidCaptureFilter
+		}
+
+		if err != nil {
+			return f, ErrInvalidCaptureFilter
+		}
+	}
+
+	for i, word := range words {
+		if i > 0 {
+			f.expression += " "
+		}
+		f.expression += word
+	}
+
+	return
+}
+
+func (f *CaptureFilter) Match(packet []byte) bool {
+	if f.expression == "" {
+		return true
+	}
+
+	info, ok := parsePacketInfo(packet)
+	if !ok {
+		return false
+	}
+
+	if f.Host.IsValid() && info.Source != f.Host && info.Destination != f.Host {
+		return false
+	}
+
+	if f.Port != 0 && (!info.HasPorts || (info.SourcePort != f.Port && info.DestinationPort != f.Port)) {
+		return false
+	}
+
+	if f.Quad[0].IsValid() {
+		if !info.HasPorts {
+			return false
+		}
+
+		source := netip.AddrPortFrom(info.Source, info.SourcePort)
+		destination := netip.AddrPortFrom(info.Destination, info.DestinationPort)
+		if !(source == f.Quad[0] && destination == f.Quad[1]) && !(source == f.Quad[1] && destination == f.Quad[0]) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (f CaptureFilter) String() string {
+	if f.expression == "" {
+		return "all packets"
+	}
+	return f.expression
+}
+
+// Capture writes packets to a libpcap file, starting a new file whenever the
+// current one reaches MaxBytes (like tcpdump -C). The first file is Path and
+// later ones are Path.1, Path.2, and so on.
+type Capture struct {
+	Path     string
+	MaxBytes int64
+	Filter   CaptureFilter
+
+	file    *os.File
+	written int64
+	index   int
+	packets int
+}
+
+func NewCapture(path string, maxBytes int64, filter CaptureFilter) (*Capture, error) {
+	c := &Capture{Path: path, MaxBytes: maxBytes, Filter: filter}
+	return c, c.open()
+}
+
+func (c *Capture) open() error {
+	path := c.Path
+	if c.index > 0 {
+		path = fmt.Sprintf("%s.%d", c.Path, c.index)
+	}
+
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+
+	header := make([]byte, PCAP_HEADER_LENGTH)
+	binary.LittleEndian.PutUint32(header[0:], PCAP_MAGIC_MICROSECONDS)
+	binary.LittleEndian.PutUint16(header[4:], PCAP_VERSION_MAJOR)
+	binary.LittleEndian.PutUint16(header[6:], PCAP_VERSION_MINOR)
+	binary.LittleEndian.PutUint32(header[16:], PCAP_SNAPLEN)
+	binary.LittleEndian.PutUint32(header[20:], LINKTYPE_RAW)
+
+	_, err = file.Write(header)
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	c.file = file
+	c.written = PCAP_HEADER_LENGTH
+	return nil
+}
+
+// Write records a packet seen at the given time, if it passes the filter.
+func (c *Capture) Write(packet []byte, now time.Time) error {
+	if !c.Filter.Match(packet) {
+		return nil
+	}
+
+	size := len(packet)
+	if size > PCAP_SNAPLEN {
+		size = PCAP_SNAPLEN
+	}
+
+	if c.MaxBytes > 0 && c.written+int64(PCAP_RECORD_HEADER_LENGTH+size) > c.MaxBytes && c.written > PCAP_HEADER_LENGTH {
+		c.file.Close()
+		c.index++
+		if err := c.open(); err != nil {
+			return err
+		}
+	}
+
+	record := make([]byte, PCAP_RECORD_HEADER_LENGTH, PCAP_RECORD_HEADER_LENGTH+size)
+	binary.LittleEndian.PutUint32(record[0:], uint32(now.Unix()))
+	binary.LittleEndian.PutUint32(record[4:], uint32(now.Nanosecond()/1000))
+	binary.LittleEndian.PutUint32(record[8:], uint32(size))
+	binary.LittleEndian.PutUint32(record[12:], uint32(len(packet)))
+	record = append(record, packet[:size]...)
+
+	_, err := c.file.Write(record)
+	c.written += int64(len(record))
+	c.packets++
+	return err
+}
+
+func (c *Capture) Close() error {
+	return c.file.Close()
+}
+
+// CaptureLink sits between the stack and the link, handing every IP packet
+// read or written to the current capture, if there is one.
+type CaptureLink struct {
+	dev io.ReadWriter
+
+	// The file size to rotate at for captures started from the REPL, or 0
+	MaxBytes int64
+
+	mu      sync.Mutex
+	capture *Capture
+}
+
+func NewCaptureLink(dev io.ReadWriter, maxBytes int64) *CaptureLink {
+	return &CaptureLink{dev: dev, MaxBytes: maxBytes}
+}
+
+func (l *CaptureLink) Read(p []byte) (int, error) {
+	n, err := l.dev.Read(p)
+	if err == nil {
+		l.record(p[:n])
+	}
+	return n, err
+}
+
+func (l *CaptureLink) Write(p []byte) (int, error) {
+	l.record(p)
+	return l.dev.Write(p)
+}
+
+func (l *CaptureLink) record(packet []byte) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.capture == nil {
+		return
+	}
+
+	err := l.capture.Write(packet, time.Now())
+	if err != nil {
+		linkLog.Error("capture stopped", "err", err)
+		l.capture.Close()
+		l.capture = nil
+	}
+}
+
+// Start begins capturing to a new file, replacing any capture in progress.
+func (l *CaptureLink) Start(path string, filter CaptureFilter) error {
+	capture, err := NewCapture(path, l.MaxBytes, filter)
+	if err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.capture != nil {
+		l.capture.Close()
+	}
+	l.capture = capture
+	return nil
+}
+
+func (l *CaptureLink) Stop() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.capture == nil {
+		return fmt.Errorf("not capturing")
+	}
+
+	err := l.capture.Close()
+	l.capture = nil
+	return err
+}
+
+func (l *CaptureLink) Inspect() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.capture == nil {
+		fmt.Printf("not capturing\n")
+		return
+	}
+
+	c := l.capture
+	fmt.Printf("capturing %s to %s (file %d, %d packets, %d bytes)\n", c.Filter, c.Path, c.index, c.packets, c.written)
+}
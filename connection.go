@@ -4,238 +4,940 @@ import (
 	"bytes"
 	"fmt"
 	"io"
-	"math/rand"
-	"os"
 	"sync"
+	"time"
 )
 
 const (
 	WRITE_BUFFER_BYTES = 1024
+
+	// Data received but not yet read is limited to this, and the receive
+	// window advertises whatever is left of it
+	READ_BUFFER_BYTES = 1024
+
+	// RFC 9293 §3.7.1: assume 536 bytes if the peer doesn't send an MSS option
+	DEFAULT_MSS = 536
+
+	// The same for IPv6 (RFC 8200's minimum MTU less the headers)
+	DEFAULT_IPV6_MSS = IPV6_MIN_MTU - TCP_IPV6_HEADER_LENGTH
+
+	// RFC 6298 §2.1
+	INITIAL_RTO = 1 * time.Second
+
+	// RFC 6298 §2.5 allows capping the RTO at no less than 60 seconds
+	MAX_RTO = 60 * time.Second
+
+	// A half-open connection is dropped after this many unanswered SYN-ACKs
+	SYN_ACK_RETRIES = 5
+
+	// An established connection is dropped after this many consecutive
+	// retransmission timeouts (RFC 1122 §4.2.3.5's R2)
+	DATA_RETRIES = 8
+
+	// Maximum segment lifetime; connections linger in TIME-WAIT for twice this
+	MSL = 30 * time.Second
+
+	// How long a connection that has been closed for reading waits in
+	// FIN-WAIT-2 for the peer's FIN, like Linux's tcp_fin_timeout
+	FIN_WAIT_2_TIMEOUT = 60 * time.Second
 )
 
-type ConnectionState string
+var ErrFinWait2Timeout = fmt.Errorf("timed out waiting for FIN")
 
 type Connection struct {
 	mu sync.Mutex
 
+	ID    int
+	Quad  Quad
 	State ConnectionState
 
+	events *EventBus
+
 	SendWindow                                      uint16
-	SendUnacknowledged, SendNext, SendUrgentPointer uint32
-	SendWL1, SendWL2, InitialSendSequenceNumber     uint32
+	SendUnacknowledged, SendNext, SendUrgentPointer SeqNum
+	SendWL1, SendWL2, InitialSendSequenceNumber     SeqNum
 
-	ReceiveNext, ReceiveUrgentPointer, InitialReceiveSequenceNumber uint32
+	ReceiveNext, ReceiveUrgentPointer, InitialReceiveSequenceNumber SeqNum
 	ReceiveWindow                                                   uint16
+
+	SendMSS      uint16
+	DontFragment bool
+
+	// Whether segments are traced even when tracing is off globally, and the
+	// state as of the last segment, traced or not
+	Trace       bool
+	tracedState ConnectionState
+
+	// The MSS that fits in the path MTU, or 0 if it's unknown
+	PathMSS uint16
+	PLPMTUD PLPMTUD
+
+	// Data that has been sent but not acknowledged, starting at SND.UNA
+	sendBuffer []byte
+	sendUrgent bool
+
+	RetransmitTimeout  time.Duration
+	RetransmitDeadline time.Time
+	Retransmits        int
+	TimeWaitDeadline   time.Time
+	FinWait2Deadline   time.Time
+
+	// The last soft ICMP error received since the peer last made progress. If
+	// the connection times out, this is reported instead of a generic timeout.
+	SoftError error
+
+	// Data received from the peer that hasn't been read yet. ReceiveClosed is
+	// set once the peer's FIN has been received, and ReadClosed once the user
+	// has closed the read side.
+	received                  bytes.Buffer
+	readable                  *sync.Cond
+	ReceiveClosed, ReadClosed bool
+	aborted                   error
 }
 
+var ErrConnectionAborted = fmt.Errorf("connection aborted")
+
+func (c *Connection) GetState() ConnectionState {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.State
+}
+
+func (c *Connection) GetDontFragment() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.DontFragment
+}
+
+func (c *Connection) SetDontFragment(df bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.DontFragment = df
+}
+
+// Close shuts down both directions. Any data the peer sends after this is
+// answered with a reset. If the send side has already been shut down, no
+// segment needs to be sent and the response is empty.
 func (c *Connection) Close(quad Quad) (response TCP, err error) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	if c.State != "ESTAB" && c.State != "SYN-RECEIVED" && c.State != "CLOSE-WAIT" {
+	if c.ReadClosed {
+		return response, fmt.Errorf("connection is already closed")
+	}
+
+	if c.State == FIN_WAIT_1 || c.State == FIN_WAIT_2 || c.State == CLOSING || c.State == LAST_ACK {
+		c.ReadClosed = true
+		return
+	}
+
+	response, err = c.closeWrite(quad)
+	if err == nil {
+		c.ReadClosed = true
+	}
+	return
+}
+
+// CloseWrite sends a FIN but leaves the receive side open, so data from the
+// peer can still be read until it closes its side too.
+func (c *Connection) CloseWrite(quad Quad) (response TCP, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.closeWrite(quad)
+}
+
+func (c *Connection) closeWrite(quad Quad) (response TCP, err error) {
+	if c.State != ESTABLISHED && c.State != SYN_RECEIVED && c.State != CLOSE_WAIT {
 		return response, fmt.Errorf("can only close an established connection")
 	}
 
-	response.SourcePort = quad.DestinationPort
-	response.DestinationPort = quad.SourcePort
-	response.SequenceNumber = c.SendNext
-	response.AcknowledgmentNumber = c.ReceiveNext
-	response.DataOffset = 5
-	response.Window = 1024
-	response.ControlBits |= 0x01 // FIN
-	response.ControlBits |= 0x10 // ACK
+	c.SendNext = c.SendNext.Add(1)
+	response = c.finSegment(quad)
 
-	c.SendNext = response.SequenceNumber + 1
+	// The FIN is retransmitted like data until it's acknowledged
+	if c.RetransmitDeadline.IsZero() {
+		c.RetransmitTimeout = INITIAL_RTO
+		c.RetransmitDeadline = time.Now().Add(c.RetransmitTimeout)
+	}
 
-	if c.State == "CLOSE-WAIT" {
-		c.State = "LAST-ACK"
+	if c.State == CLOSE_WAIT {
+		err = c.setState(LAST_ACK)
 	} else {
-		c.State = "FIN-WAIT-1"
+		err = c.setState(FIN_WAIT_1)
 	}
 
 	return
 }
 
-func (c *Connection) Write(buf []byte, quad Quad) (response TCP, err error) {
+// finSegment builds our FIN, once it's been given the last sequence number
+// before SND.NXT.
+func (c *Connection) finSegment(quad Quad) (fin TCP) {
+	fin.SourcePort = quad.DestinationPort
+	fin.DestinationPort = quad.SourcePort
+	fin.SequenceNumber = uint32(c.SendNext) - 1
+	fin.AcknowledgmentNumber = uint32(c.ReceiveNext)
+	fin.DataOffset = 5
+	fin.Window = c.ReceiveWindow
+	fin.ControlBits |= 0x01 // FIN
+	fin.ControlBits |= 0x10 // ACK
+	return
+}
+
+// finOutstanding reports whether we've sent a FIN that hasn't been
+// acknowledged: SND.NXT is past the end of the queued data.
+func (c *Connection) finOutstanding() bool {
+	return c.SendNext.GreaterThan(c.SendUnacknowledged.Add(uint32(len(c.sendBuffer))))
+}
+
+// Write queues buf for sending, returning the segments to put on the wire.
+// The data is kept until it's acknowledged so it can be retransmitted.
+func (c *Connection) Write(buf []byte, quad Quad) (segments []outgoing, err error) {
+	return c.write(buf, quad, false)
+}
+
+// WriteUrgent sends buf as urgent data: the segments have URG set, with the
+// urgent pointer at the octet following buf (RFC 9293 §3.8.5).
+func (c *Connection) WriteUrgent(buf []byte, quad Quad) (segments []outgoing, err error) {
+	return c.write(buf, quad, true)
+}
+
+func (c *Connection) write(buf []byte, quad Quad, urgent bool) (segments []outgoing, err error) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	if c.State != "ESTAB" && c.State != "CLOSE-WAIT" {
-		return response, fmt.Errorf("can only write to an established connection")
+	if c.State != ESTABLISHED && c.State != CLOSE_WAIT {
+		return nil, fmt.Errorf("can only write to an established connection")
 	}
 
-	response.SourcePort = quad.DestinationPort
-	response.DestinationPort = quad.SourcePort
-	response.SequenceNumber = c.SendNext
-	response.AcknowledgmentNumber = c.ReceiveNext
-	response.DataOffset = 5
-	response.ControlBits |= 0x10 // ACK
-	response.Window = 1024
+	now := time.Now()
+	start := c.SendNext
+	c.sendBuffer = append(c.sendBuffer, buf...)
+	c.SendNext = c.SendNext.Add(uint32(len(buf)))
+
+	if urgent {
+		c.SendUrgentPointer = c.SendNext
+		c.sendUrgent = true
+	}
+
+	if c.RetransmitDeadline.IsZero() {
+		c.RetransmitTimeout = INITIAL_RTO
+		c.RetransmitDeadline = now.Add(c.RetransmitTimeout)
+	}
+
+	// If there's enough new data, send the first segment as a PLPMTUD probe
+	if size := c.probeSize(now); size > c.EffectiveMSS() && uint32(size) <= start.Diff(c.SendNext) {
+		end := start.Add(uint32(size))
+		c.startProbe(start, size)
+		segments = c.split(quad, start, end, size)
+		return append(segments, c.segments(quad, end, c.SendNext)...), nil
+	}
+
+	return c.segments(quad, start, c.SendNext), nil
+}
+
+// EffectiveMSS is the largest payload we'll put in a segment: the peer's MSS,
+// capped by what fits in the path MTU.
+func (c *Connection) EffectiveMSS() uint16 {
+	if c.PathMSS != 0 && c.PathMSS < c.SendMSS {
+		return c.PathMSS
+	}
+	return c.SendMSS
+}
+
+// segments splits the unacknowledged data in [from, to) into segments of at
+// most EffectiveMSS bytes.
+func (c *Connection) segments(quad Quad, from, to SeqNum) []outgoing {
+	return c.split(quad, from, to, c.EffectiveMSS())
+}
+
+func (c *Connection) split(quad Quad, from, to SeqNum, maxSize uint16) (segments []outgoing) {
+	mss := uint32(maxSize)
+	offset := from.Diff(c.SendUnacknowledged)
+	end := to.Diff(c.SendUnacknowledged)
+	if end > uint32(len(c.sendBuffer)) {
+		end = uint32(len(c.sendBuffer))
+	}
+
+	for offset < end {
+		size := end - offset
+		if size > mss {
+			size = mss
+		}
+
+		seq := c.SendUnacknowledged.Add(offset)
+
+		var tcp TCP
+		tcp.SourcePort = quad.DestinationPort
+		tcp.DestinationPort = quad.SourcePort
+		tcp.SequenceNumber = uint32(seq)
+		tcp.AcknowledgmentNumber = uint32(c.ReceiveNext)
+		tcp.DataOffset = 5
+		tcp.ControlBits |= 0x10 // ACK
+		tcp.Window = c.ReceiveWindow
 
-	c.SendNext = response.SequenceNumber + uint32(len(buf))
+		if c.sendUrgent && c.SendUrgentPointer.GreaterThan(seq) {
+			tcp.ControlBits |= 0x20 // URG
+			tcp.UrgentPointer = uint16(c.SendUrgentPointer.Diff(seq))
+		}
+
+		payload := append([]byte{}, c.sendBuffer[offset:offset+size]...)
+		segments = append(segments, outgoing{Quad: quad, TCP: tcp, Payload: payload})
+
+		offset += size
+	}
 
 	return
 }
 
-func (c *Connection) Initialize(header *TCP) {
+// Retransmit returns segments carrying all data that hasn't been acknowledged.
+func (c *Connection) Retransmit(quad Quad) []outgoing {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	segments := c.segments(quad, c.SendUnacknowledged, c.SendNext)
+	if len(segments) > 0 {
+		c.emit(Event{Type: EventRetransmission})
+	}
+	return segments
+}
+
+// Read reads data received from the peer, blocking until some is available.
+// It returns io.EOF once the peer's FIN has been received and everything
+// before it has been read.
+func (c *Connection) Read(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for c.received.Len() == 0 && !c.ReceiveClosed && c.aborted == nil {
+		c.readable.Wait()
+	}
+
+	if c.received.Len() == 0 {
+		if c.aborted != nil {
+			return 0, c.aborted
+		}
+		return 0, io.EOF
+	}
+
+	n, err := c.received.Read(p)
+	c.updateReceiveWindow()
+	return n, err
+}
+
+// updateReceiveWindow sets RCV.WND to the space left in the read buffer. The
+// next segment we send advertises it.
+func (c *Connection) updateReceiveWindow() {
+	c.ReceiveWindow = uint16(max(READ_BUFFER_BYTES-c.received.Len(), 0))
+}
+
+// Abort wakes up any blocked readers after the connection has been discarded.
+// They're given err, or ErrConnectionAborted if it's nil.
+func (c *Connection) Abort(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err == nil {
+		err = ErrConnectionAborted
+	}
+
+	c.aborted = err
+	c.readable.Broadcast()
+}
+
+func (c *Connection) Inspect() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	fmt.Printf("Connection %d: %+v %s\n", c.ID, c.Quad, c.State)
+	fmt.Printf("SND.UNA/NXT/WND:    %d/%d/%d\n", c.SendUnacknowledged, c.SendNext, c.SendWindow)
+	fmt.Printf("RCV.NXT/WND:        %d/%d\n", c.ReceiveNext, c.ReceiveWindow)
+	fmt.Printf("MSS:                %d (peer %d, path %d)\n", c.EffectiveMSS(), c.SendMSS, c.PathMSS)
+	fmt.Printf("Unacknowledged:     %d bytes\n", len(c.sendBuffer))
+	fmt.Printf("RTO:                %s (%d retransmits)\n", c.RetransmitTimeout, c.Retransmits)
+	if c.SoftError != nil {
+		fmt.Printf("Soft error:         %s\n", c.SoftError)
+	}
+	if pending, ok := c.urgentPending(); ok {
+		fmt.Printf("Urgent data:        %d bytes to the mark\n", pending)
+	}
+	c.PLPMTUD.Inspect()
+}
+
+// Summary describes the connection in one line, for listing connections.
+func (c *Connection) Summary() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return fmt.Sprintf("%s SND.UNA/NXT %d/%d RCV.NXT %d, %d bytes unacknowledged, %d unread",
+		c.State, c.SendUnacknowledged, c.SendNext, c.ReceiveNext, len(c.sendBuffer), c.received.Len())
+}
+
+func (c *Connection) Initialize(header *TCP, iss SeqNum) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	c.State = "LISTEN"
+	c.setState(LISTEN)
+	c.readable = sync.NewCond(&c.mu)
 
-	c.InitialSendSequenceNumber = rand.Uint32()
+	c.InitialSendSequenceNumber = iss
 	c.SendUnacknowledged = c.InitialSendSequenceNumber
-	c.SendNext = c.InitialSendSequenceNumber + 1
+	c.SendNext = c.InitialSendSequenceNumber
 	c.SendWindow = header.Window
 
-	c.InitialReceiveSequenceNumber = header.SequenceNumber
-	c.ReceiveNext = header.SequenceNumber + 1
-	c.ReceiveWindow = 1024
+	c.InitialReceiveSequenceNumber = SeqNum(header.SequenceNumber)
+	c.ReceiveNext = c.InitialReceiveSequenceNumber.Add(1)
+	c.ReceiveWindow = READ_BUFFER_BYTES
+
+	c.SendMSS = header.MaxSegmentSize
+	if c.SendMSS == 0 && c.Quad.SourceIP.Is4() {
+		c.SendMSS = DEFAULT_MSS
+	} else if c.SendMSS == 0 {
+		c.SendMSS = DEFAULT_IPV6_MSS
+	}
 }
 
-func (c *Connection) HandleSegment(header *TCP, payload *bytes.Reader) (response TCP, err error) {
+// InitializeFromCookie rebuilds an established connection from the final ACK
+// of a handshake that was answered with a SYN cookie.
+func (c *Connection) InitializeFromCookie(header *TCP, mss uint16) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	if c.State == "LISTEN" {
-		if header.ControlBits&0x02 != 0x02 {
-			err = fmt.Errorf("SYN bit not set")
-			return
+	c.setState(ESTABLISHED)
+	c.readable = sync.NewCond(&c.mu)
+
+	c.InitialSendSequenceNumber = SeqNum(header.AcknowledgmentNumber - 1)
+	c.SendUnacknowledged = SeqNum(header.AcknowledgmentNumber)
+	c.SendNext = SeqNum(header.AcknowledgmentNumber)
+	c.SendWindow = header.Window
+	c.SendWL1 = SeqNum(header.SequenceNumber)
+	c.SendWL2 = SeqNum(header.AcknowledgmentNumber)
+
+	c.InitialReceiveSequenceNumber = SeqNum(header.SequenceNumber - 1)
+	c.ReceiveNext = SeqNum(header.SequenceNumber)
+	c.ReceiveWindow = READ_BUFFER_BYTES
+
+	c.SendMSS = mss
+}
+
+// synAck builds the second segment of the handshake in response to a SYN.
+func synAck(header *TCP, iss SeqNum, window uint16) (response TCP) {
+	response.SourcePort = header.DestinationPort
+	response.DestinationPort = header.SourcePort
+	response.SequenceNumber = uint32(iss)
+	response.AcknowledgmentNumber = header.SequenceNumber + 1
+	response.DataOffset = 5
+
+	response.ControlBits |= 0x02 // SYN
+	response.ControlBits |= 0x10 // ACK
+
+	response.Window = window
+	return
+}
+
+// Tick runs the connection's timers. It returns any segments to retransmit, or
+// an error if the connection should be given up on.
+func (c *Connection) Tick(quad Quad, now time.Time) (segments []outgoing, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.State == TIME_WAIT && !now.Before(c.TimeWaitDeadline) {
+		return nil, c.setState(CLOSED)
+	}
+
+	// Nobody is going to read anything more from an orphaned connection, so
+	// don't wait forever for a peer that never sends its FIN
+	if c.State == FIN_WAIT_2 && c.ReadClosed {
+		if c.FinWait2Deadline.IsZero() {
+			c.FinWait2Deadline = now.Add(FIN_WAIT_2_TIMEOUT)
+		} else if !now.Before(c.FinWait2Deadline) {
+			err = c.setState(CLOSED)
+			if err != nil {
+				return nil, err
+			}
+			return nil, ErrFinWait2Timeout
 		}
+	}
 
-		response.SourcePort = header.DestinationPort
-		response.DestinationPort = header.SourcePort
-		response.SequenceNumber = c.SendNext
-		response.AcknowledgmentNumber = c.ReceiveNext
-		response.DataOffset = 5
+	if c.RetransmitDeadline.IsZero() || now.Before(c.RetransmitDeadline) {
+		return
+	}
 
+	if c.State == SYN_RECEIVED {
+		if c.Retransmits >= SYN_ACK_RETRIES {
+			return nil, c.timedOut(fmt.Errorf("SYN-ACK retransmissions exhausted"))
+		}
+
+		var response TCP
+		response.SourcePort = quad.DestinationPort
+		response.DestinationPort = quad.SourcePort
+		response.SequenceNumber = uint32(c.InitialSendSequenceNumber)
+		response.AcknowledgmentNumber = uint32(c.ReceiveNext)
+		response.DataOffset = 5
 		response.ControlBits |= 0x02 // SYN
 		response.ControlBits |= 0x10 // ACK
-
 		response.Window = c.ReceiveWindow
 
-		c.State = "SYN-RECEIVED"
+		c.emit(Event{Type: EventRetransmission})
+
+		c.Retransmits++
+		c.RetransmitTimeout *= 2
+		c.RetransmitDeadline = now.Add(c.RetransmitTimeout)
+		return []outgoing{{Quad: quad, TCP: response}}, nil
+	}
+
+	if len(c.sendBuffer) == 0 && !c.finOutstanding() {
+		c.RetransmitDeadline = time.Time{}
 		return
 	}
 
-	if c.State == "SYN-RECEIVED" {
-		if header.ControlBits&0x10 != 0x10 {
-			err = fmt.Errorf("SYN/ACK bits not set")
-			return
+	if len(c.sendBuffer) == 0 {
+		// Only the FIN is unacknowledged
+		c.Retransmits++
+		if c.Retransmits > DATA_RETRIES {
+			return nil, c.timedOut(fmt.Errorf("FIN retransmissions exhausted"))
 		}
 
-		c.SendUnacknowledged = header.AcknowledgmentNumber
-		c.SendNext = header.AcknowledgmentNumber
-		c.SendWindow = header.Window
+		c.backOff(now)
+		c.emit(Event{Type: EventRetransmission})
+		return []outgoing{{Quad: quad, TCP: c.finSegment(quad)}}, nil
+	}
 
-		c.State = "ESTAB"
-		return
+	// Retransmit the oldest unacknowledged segment (RFC 6298 §5.4)
+	size := uint32(len(c.sendBuffer))
+	if c.PLPMTUD.Probing && c.PLPMTUD.ProbeSeq == c.SendUnacknowledged {
+		size = uint32(c.PLPMTUD.ProbeSize)
+	} else if size > uint32(c.EffectiveMSS()) {
+		size = uint32(c.EffectiveMSS())
 	}
 
-	if c.State == "ESTAB" {
-		var n int64
-		n, err = io.Copy(os.Stdout, payload)
-		if err != nil {
-			return response, err
+	if !c.probeLost(now) {
+		c.Retransmits++
+		if c.Retransmits > DATA_RETRIES {
+			return nil, c.timedOut(fmt.Errorf("retransmissions exhausted"))
 		}
 
-		c.ReceiveNext = header.SequenceNumber + uint32(n)
-		c.SendUnacknowledged = header.AcknowledgmentNumber
-		c.SendWindow = header.Window
+		c.detectBlackhole(size, now)
+		c.backOff(now)
+	} else {
+		c.RetransmitDeadline = now.Add(c.RetransmitTimeout)
+	}
 
-		// FIN
-		if header.ControlBits&0x01 == 0x01 {
-			c.ReceiveNext++
-			response.SourcePort = header.DestinationPort
-			response.DestinationPort = header.SourcePort
-			response.SequenceNumber = c.SendNext
-			response.AcknowledgmentNumber = c.ReceiveNext
-			response.DataOffset = 5
-			response.ControlBits |= 0x10 // ACK
-			response.Window = 1024
+	segments = c.segments(quad, c.SendUnacknowledged, c.SendNext)[:1]
+	c.emit(Event{Type: EventRetransmission})
+	return
+}
 
-			c.SendNext = response.SequenceNumber
-			c.State = "CLOSE-WAIT"
+// backOff doubles the RTO after a timeout (RFC 6298 §5.5) and restarts the
+// timer.
+func (c *Connection) backOff(now time.Time) {
+	c.RetransmitTimeout *= 2
+	if c.RetransmitTimeout > MAX_RTO {
+		c.RetransmitTimeout = MAX_RTO
+	}
+	c.RetransmitDeadline = now.Add(c.RetransmitTimeout)
+}
 
-			return
+// timedOut returns the error to give up on the connection with: the last soft
+// error if there was one (RFC 1122 §4.2.3.9), or else err.
+func (c *Connection) timedOut(err error) error {
+	if c.SoftError != nil {
+		return c.SoftError
+	}
+	return err
+}
+
+// segmentLength is SEG.LEN: the payload plus one for each of SYN and FIN.
+func segmentLength(header *TCP, payload *bytes.Reader) uint32 {
+	n := uint32(payload.Len())
+	if header.ControlBits&0x02 == 0x02 {
+		n++
+	}
+	if header.ControlBits&0x01 == 0x01 {
+		n++
+	}
+	return n
+}
+
+// acceptable is the segment acceptability test from RFC 9293 §3.10.7.4.
+func (c *Connection) acceptable(header *TCP, segLen uint32) bool {
+	seq := SeqNum(header.SequenceNumber)
+	wnd := uint32(c.ReceiveWindow)
+
+	switch {
+	case segLen == 0 && wnd == 0:
+		return seq == c.ReceiveNext
+	case segLen == 0:
+		return seq.InWindow(c.ReceiveNext, wnd)
+	case wnd == 0:
+		return false
+	default:
+		return seq.InWindow(c.ReceiveNext, wnd) || seq.Add(segLen-1).InWindow(c.ReceiveNext, wnd)
+	}
+}
+
+// processAck applies the ACK checks for synchronized states, updating SND.UNA
+// and the send window. It returns false if the segment acknowledges data we
+// haven't sent, in which case the segment should be ACKed and dropped.
+func (c *Connection) processAck(header *TCP) bool {
+	seq := SeqNum(header.SequenceNumber)
+	ack := SeqNum(header.AcknowledgmentNumber)
+
+	if ack.GreaterThan(c.SendNext) {
+		return false
+	}
+
+	if ack.GreaterThan(c.SendUnacknowledged) {
+		acked := ack.Diff(c.SendUnacknowledged)
+		if acked > uint32(len(c.sendBuffer)) {
+			// The ACK also covers our FIN
+			acked = uint32(len(c.sendBuffer))
 		}
+		c.sendBuffer = c.sendBuffer[acked:]
 
-		// No new data, don't respond with an ACK
-		if n == 0 {
-			return
+		c.SendUnacknowledged = ack
+		if c.sendUrgent && c.SendUnacknowledged.GreaterThanEq(c.SendUrgentPointer) {
+			c.sendUrgent = false
 		}
 
-		response.AcknowledgmentNumber = c.ReceiveNext
-		response.ControlBits |= 0x10 // ACK
+		now := time.Now()
+		c.probeAcked(now)
+
+		// Progress: restart the retransmission timer, or stop it if
+		// everything, including any FIN, has been acknowledged
+		c.SoftError = nil
+		c.Retransmits = 0
+		c.RetransmitTimeout = INITIAL_RTO
+		c.RetransmitDeadline = time.Time{}
+		if c.SendUnacknowledged != c.SendNext {
+			c.RetransmitDeadline = now.Add(c.RetransmitTimeout)
+		}
+	}
 
-		response.SequenceNumber = c.SendNext
+	// Duplicate ACKs (SEG.ACK < SND.UNA) can't update the window
+	if ack.GreaterThanEq(c.SendUnacknowledged) {
+		if c.SendWL1.LessThan(seq) || (c.SendWL1 == seq && c.SendWL2.LessThanEq(ack)) {
+			if c.SendWindow != header.Window {
+				c.emit(Event{Type: EventWindowChanged, OldWindow: c.SendWindow, NewWindow: header.Window})
+			}
 
-		response.SourcePort = header.DestinationPort
-		response.DestinationPort = header.SourcePort
+			c.SendWindow = header.Window
+			c.SendWL1 = seq
+			c.SendWL2 = ack
+		}
+	}
 
-		response.DataOffset = 5
-		response.Window = c.ReceiveWindow
+	return true
+}
 
+// processUrgent advances RCV.UP if the segment has URG set, and lets the user
+// know when the urgent pointer is ahead of the data they've read.
+func (c *Connection) processUrgent(header *TCP) {
+	if header.ControlBits&0x20 != 0x20 {
 		return
 	}
 
-	if c.State == "FIN-WAIT-1" {
-		// TODO
-		if header.ControlBits&0x10 != 0x10 {
-			return response, fmt.Errorf("FIN wasn't ACKed")
-		}
+	up := SeqNum(header.SequenceNumber).Add(uint32(header.UrgentPointer))
+	if !c.ReceiveUrgentPointer.GreaterThan(c.ReceiveNext) || up.GreaterThan(c.ReceiveUrgentPointer) {
+		c.ReceiveUrgentPointer = up
+	}
 
-		if header.ControlBits&0x01 == 0x01 {
-			// FIN + ACK
-			c.ReceiveNext = header.SequenceNumber + 1
-			c.SendUnacknowledged = header.AcknowledgmentNumber
-			c.SendWindow = header.Window
+	if pending, ok := c.urgentPending(); ok {
+		c.logger().Info("urgent data pending", "bytes", pending)
+		c.emit(Event{Type: EventUrgentData, Bytes: pending})
+	}
+}
 
-			response.SourcePort = header.DestinationPort
-			response.DestinationPort = header.SourcePort
-			response.SequenceNumber = c.SendNext
-			response.AcknowledgmentNumber = c.ReceiveNext
-			response.DataOffset = 5
-			response.ControlBits |= 0x10 // ACK
-			response.Window = 1024
+// UrgentPending returns how many more bytes Read has to return to reach the
+// urgent mark (the end of the urgent data), or false if there's no urgent
+// data that hasn't been read.
+func (c *Connection) UrgentPending() (int, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 
-			c.SendNext = response.SequenceNumber + 1
+	return c.urgentPending()
+}
 
-			c.State = "CLOSED"
-		} else {
-			// ACK
-			c.State = "FIN-WAIT-2"
+func (c *Connection) urgentPending() (int, bool) {
+	// The sequence number of the next byte Read will return
+	read := SeqNum(uint32(c.ReceiveNext) - uint32(c.received.Len()))
+	if !c.ReceiveUrgentPointer.GreaterThan(read) {
+		return 0, false
+	}
+	return int(c.ReceiveUrgentPointer.Diff(read)), true
+}
+
+func (c *Connection) enterTimeWait() error {
+	c.TimeWaitDeadline = time.Now().Add(2 * MSL)
+	return c.setState(TIME_WAIT)
+}
+
+// emit publishes an event about this connection.
+func (c *Connection) emit(e Event) {
+	e.Quad = c.Quad
+	e.ConnectionID = c.ID
+	c.events.Publish(e)
+}
+
+// reset builds a RST for a segment we won't accept, acknowledging everything
+// we've received so far.
+func (c *Connection) reset(header *TCP) (response TCP) {
+	response = c.ack(header)
+	response.ControlBits |= 0x04 // RST
+	return
+}
+
+// ack builds a bare ACK reflecting the current send and receive state.
+func (c *Connection) ack(header *TCP) (response TCP) {
+	response.SourcePort = header.DestinationPort
+	response.DestinationPort = header.SourcePort
+	response.SequenceNumber = uint32(c.SendNext)
+	response.AcknowledgmentNumber = uint32(c.ReceiveNext)
+	response.DataOffset = 5
+	response.ControlBits |= 0x10 // ACK
+	response.Window = c.ReceiveWindow
+	return
+}
+
+// segmentHandlers processes a segment that has passed the checks common to
+// all states in HandleSegment. There's one per state that can receive segments.
+var segmentHandlers = map[ConnectionState]func(*Connection, *TCP, *bytes.Reader) (TCP, error){
+	LISTEN:       (*Connection).handleListen,
+	SYN_RECEIVED: (*Connection).handleSynReceived,
+	ESTABLISHED:  (*Connection).handleEstablished,
+	FIN_WAIT_1:   (*Connection).handleFinWait1,
+	FIN_WAIT_2:   (*Connection).handleFinWait2,
+	CLOSE_WAIT:   (*Connection).handleCloseWait,
+	CLOSING:      (*Connection).handleClosing,
+	LAST_ACK:     (*Connection).handleLastAck,
+	TIME_WAIT:    (*Connection).handleTimeWait,
+}
+
+func (c *Connection) HandleSegment(header *TCP, payload *bytes.Reader) (response TCP, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	handler, ok := segmentHandlers[c.State]
+	if !ok {
+		return response, fmt.Errorf("can't handle segments in state %s", c.State)
+	}
+
+	if c.State == LISTEN {
+		return handler(c, header, payload)
+	}
+
+	if !c.acceptable(header, segmentLength(header, payload)) {
+		// Never ACK an unacceptable RST
+		if header.ControlBits&0x04 == 0x04 {
+			drops.Add(c.logger(), "RST outside receive window", "seq", header.SequenceNumber)
+			return
 		}
+		drops.Add(c.logger(), "segment outside receive window", "seq", header.SequenceNumber)
+		return c.ack(header), nil
 	}
 
-	if c.State == "LAST-ACK" {
+	if header.ControlBits&0x04 == 0x04 {
+		// RST; the acceptability check has already confirmed it's in window.
+		// This comes before the ACK checks, as a peer that has lost state
+		// resets with <SEQ=SEG.ACK><CTL=RST>, which carries no ACK.
+		c.emit(Event{Type: EventReset})
+		return response, c.setState(CLOSED)
+	}
+
+	if header.ControlBits&0x02 == 0x02 {
+		// A SYN in window may be forged (RFC 5961 §4), so send a challenge
+		// ACK instead of resetting. A peer that really has restarted answers
+		// it with a RST.
+		drops.Add(c.logger(), "SYN after handshake", "seq", header.SequenceNumber)
+		return c.ack(header), nil
+	}
+
+	if c.State.Synchronized() {
 		if header.ControlBits&0x10 != 0x10 {
-			return response, fmt.Errorf("didn't receive a FIN while in FIN-WAIT-2")
+			// Segments without an ACK are dropped once synchronized
+			drops.Add(c.logger(), "segment without ACK", "seq", header.SequenceNumber)
+			return
 		}
-	}
 
-	if c.State == "FIN-WAIT-2" {
-		// TODO
-		if header.ControlBits&0x01 != 0x01 {
-			return response, fmt.Errorf("didn't receive a FIN while in FIN-WAIT-2")
+		if !c.processAck(header) {
+			drops.Add(c.logger(), "unacceptable ACK", "ack", header.AcknowledgmentNumber)
+			return c.ack(header), nil
 		}
 
-		// FIN + ACK
-		c.ReceiveNext = header.SequenceNumber + 1
-		c.SendUnacknowledged = header.AcknowledgmentNumber
-		c.SendWindow = header.Window
+		seq := SeqNum(header.SequenceNumber)
+		if seq.GreaterThan(c.ReceiveNext) {
+			// Out of order; there's no reassembly queue yet, so re-ACK what we
+			// have and let the peer retransmit
+			drops.Add(c.logger(), "out of order segment", "seq", header.SequenceNumber)
+			return c.ack(header), nil
+		}
 
+		if c.ReadClosed && uint32(payload.Len()) > c.ReceiveNext.Diff(seq) {
+			// RFC 1122 §4.2.2.13: nobody is going to read this, so reset
+			c.emit(Event{Type: EventReset})
+			return c.reset(header), c.setState(CLOSED)
+		}
+	}
+
+	return handler(c, header, payload)
+}
+
+func (c *Connection) handleListen(header *TCP, payload *bytes.Reader) (response TCP, err error) {
+	if header.ControlBits&0x02 != 0x02 {
+		err = fmt.Errorf("SYN bit not set")
+		return
+	}
+
+	response = synAck(header, c.SendNext, c.ReceiveWindow)
+
+	c.SendNext = c.SendNext.Add(1)
+	c.RetransmitTimeout = INITIAL_RTO
+	c.RetransmitDeadline = time.Now().Add(c.RetransmitTimeout)
+	return response, c.setState(SYN_RECEIVED)
+}
+
+func (c *Connection) handleSynReceived(header *TCP, payload *bytes.Reader) (response TCP, err error) {
+	if header.ControlBits&0x10 != 0x10 {
+		err = fmt.Errorf("SYN/ACK bits not set")
+		return
+	}
+
+	ack := SeqNum(header.AcknowledgmentNumber)
+	if !ack.GreaterThan(c.SendUnacknowledged) || ack.GreaterThan(c.SendNext) {
+		// <SEQ=SEG.ACK><CTL=RST>
 		response.SourcePort = header.DestinationPort
 		response.DestinationPort = header.SourcePort
-		response.SequenceNumber = c.SendNext
-		response.AcknowledgmentNumber = c.ReceiveNext
+		response.SequenceNumber = header.AcknowledgmentNumber
 		response.DataOffset = 5
-		response.ControlBits |= 0x10 // ACK
-		response.Window = 1024
+		response.ControlBits |= 0x04 // RST
+		return
+	}
+
+	c.SendUnacknowledged = ack
+	c.SendWindow = header.Window
+	c.SendWL1 = SeqNum(header.SequenceNumber)
+	c.SendWL2 = ack
+
+	c.RetransmitDeadline = time.Time{}
+	c.Retransmits = 0
+	c.SoftError = nil
+
+	err = c.setState(ESTABLISHED)
+	if err != nil {
+		return
+	}
+
+	// RFC 9293 §3.10.7.4: carry on processing the segment in ESTABLISHED, so
+	// any data or FIN on the final ACK of the handshake isn't lost
+	return c.handleEstablished(header, payload)
+}
+
+func (c *Connection) handleEstablished(header *TCP, payload *bytes.Reader) (response TCP, err error) {
+	n, fin := c.receive(header, payload)
+
+	if fin {
+		err = c.setState(CLOSE_WAIT)
+	}
+
+	// No new data, don't respond with an ACK
+	if n == 0 && !fin {
+		return
+	}
 
-		c.SendNext = response.SequenceNumber + 1
+	return c.ack(header), err
+}
+
+func (c *Connection) handleFinWait1(header *TCP, payload *bytes.Reader) (response TCP, err error) {
+	n, fin := c.receive(header, payload)
+	finAcked := c.SendUnacknowledged == c.SendNext
+
+	if fin && finAcked {
+		err = c.enterTimeWait()
+	} else if fin {
+		err = c.setState(CLOSING)
+	} else if finAcked {
+		err = c.setState(FIN_WAIT_2)
+	}
+
+	if n == 0 && !fin {
+		return
+	}
+
+	return c.ack(header), err
+}
+
+func (c *Connection) handleFinWait2(header *TCP, payload *bytes.Reader) (response TCP, err error) {
+	n, fin := c.receive(header, payload)
+
+	if fin {
+		err = c.enterTimeWait()
+	}
+
+	if n == 0 && !fin {
+		return
+	}
+
+	return c.ack(header), err
+}
+
+func (c *Connection) handleCloseWait(header *TCP, payload *bytes.Reader) (response TCP, err error) {
+	// The peer has already sent its FIN, so there's nothing more to receive
+	return
+}
+
+func (c *Connection) handleClosing(header *TCP, payload *bytes.Reader) (response TCP, err error) {
+	if c.SendUnacknowledged == c.SendNext {
+		err = c.enterTimeWait()
+	}
+	return
+}
+
+func (c *Connection) handleLastAck(header *TCP, payload *bytes.Reader) (response TCP, err error) {
+	if c.SendUnacknowledged == c.SendNext {
+		err = c.setState(CLOSED)
+	}
+	return
+}
+
+func (c *Connection) handleTimeWait(header *TCP, payload *bytes.Reader) (response TCP, err error) {
+	// The peer didn't see our ACK of its FIN; ACK again and restart the timer
+	if header.ControlBits&0x01 == 0x01 {
+		c.TimeWaitDeadline = time.Now().Add(2 * MSL)
+		return c.ack(header), nil
+	}
+	return
+}
+
+// receive queues any new data in an in-order segment for reading, and reports
+// whether the segment carried the peer's FIN.
+func (c *Connection) receive(header *TCP, payload *bytes.Reader) (n int64, fin bool) {
+	c.processUrgent(header)
+
+	// Skip over anything we've already received
+	payload.Seek(int64(c.ReceiveNext.Diff(SeqNum(header.SequenceNumber))), io.SeekCurrent)
+
+	// Anything past the window is dropped, and the peer will retransmit it
+	n, _ = c.received.ReadFrom(io.LimitReader(payload, int64(c.ReceiveWindow)))
+	c.ReceiveNext = c.ReceiveNext.Add(uint32(n))
+	c.updateReceiveWindow()
+
+	// The FIN comes after the last byte, so it's only received with all of
+	// the data
+	fin = header.ControlBits&0x01 == 0x01 && payload.Len() == 0
+	if fin {
+		c.ReceiveNext = c.ReceiveNext.Add(1)
+		c.ReceiveClosed = true
+	}
+
+	if n > 0 || fin {
+		c.readable.Broadcast()
+	}
 
-		c.State = "CLOSED"
+	if n > 0 {
+		c.emit(Event{Type: EventDataReceived, Bytes: int(n)})
 	}
 
 	return
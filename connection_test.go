@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestAcceptable(t *testing.T) {
+	tests := []struct {
+		name   string
+		rcvNxt SeqNum
+		rcvWnd uint16
+		seq    uint32
+		segLen uint32
+		want   bool
+	}{
+		{"empty at RCV.NXT, zero window", 0xFFFFFFFF, 0, 0xFFFFFFFF, 0, true},
+		{"empty past RCV.NXT, zero window", 0xFFFFFFFF, 0, 0, 0, false},
+		{"empty in window across wrap", 0xFFFFFF00, 1024, 0x10, 0, true},
+		{"empty past window across wrap", 0xFFFFFF00, 1024, 0x300, 0, false},
+		{"empty before window", 0x10, 1024, 0xFFFFFFF0, 0, false},
+		{"data, zero window", 0xFFFFFFFF, 0, 0xFFFFFFFF, 1, false},
+		{"data starting in window across wrap", 0xFFFFFF00, 1024, 0xFFFFFFF0, 100, true},
+		{"data ending in window across wrap", 0x10, 1024, 0xFFFFFFF0, 0x30, true},
+		{"data entirely before window", 0x10, 1024, 0xFFFFFFF0, 0x20, false},
+		{"data entirely past window", 0xFFFFFF00, 1024, 0x300, 10, false},
+	}
+
+	for _, test := range tests {
+		c := &Connection{ReceiveNext: test.rcvNxt, ReceiveWindow: test.rcvWnd}
+		header := &TCP{SequenceNumber: test.seq}
+		if got := c.acceptable(header, test.segLen); got != test.want {
+			t.Errorf("%s: acceptable(seq=%d, len=%d) = %v, want %v", test.name, test.seq, test.segLen, got, test.want)
+		}
+	}
+}
+
+// handshake returns a connection that's received a SYN with sequence number
+// 1000 and answered it with ISS 5000, and the SYN-ACK it sent.
+func handshake(t *testing.T) (*Connection, TCP) {
+	c := &Connection{Quad: Quad{SourcePort: 80, DestinationPort: 40000}}
+	syn := &TCP{SourcePort: 40000, DestinationPort: 80, SequenceNumber: 1000, ControlBits: 0x02, Window: 1024}
+	c.Initialize(syn, 5000)
+
+	synAck, err := c.HandleSegment(syn, bytes.NewReader(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c, synAck
+}
+
+func TestHandleSegmentSynReceived(t *testing.T) {
+	tests := []struct {
+		name      string
+		flags     uint8
+		ack       uint32
+		wantFlags uint8
+		wantSeq   uint32
+		wantState ConnectionState
+	}{
+		{"final ACK", 0x10, 5001, 0, 0, ESTABLISHED},
+		{"ACK of unsent data", 0x10, 5002, 0x04, 5002, SYN_RECEIVED},
+		{"ACK of nothing", 0x10, 5000, 0x04, 5000, SYN_RECEIVED},
+		{"RST", 0x04, 0, 0, 0, CLOSED},
+		{"SYN", 0x02, 0, 0x10, 5001, SYN_RECEIVED},
+	}
+
+	for _, test := range tests {
+		c, _ := handshake(t)
+		segment := &TCP{SourcePort: 40000, DestinationPort: 80, SequenceNumber: 1001, AcknowledgmentNumber: test.ack, ControlBits: test.flags, Window: 1024}
+
+		response, err := c.HandleSegment(segment, bytes.NewReader(nil))
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		if response.ControlBits != test.wantFlags || response.SequenceNumber != test.wantSeq {
+			t.Errorf("%s: response flags %#x seq %d, want flags %#x seq %d", test.name, response.ControlBits, response.SequenceNumber, test.wantFlags, test.wantSeq)
+		}
+		if c.State != test.wantState {
+			t.Errorf("%s: state %s, want %s", test.name, c.State, test.wantState)
+		}
+	}
+}
+
+func TestHandleSegmentEstablished(t *testing.T) {
+	tests := []struct {
+		name      string
+		flags     uint8
+		seq, ack  uint32
+		wantFlags uint8
+		wantState ConnectionState
+		wantUna   SeqNum
+	}{
+		{"ACK of some data", 0x10, 1001, 5003, 0, ESTABLISHED, 5003},
+		{"ACK of all data", 0x10, 1001, 5006, 0, ESTABLISHED, 5006},
+		{"duplicate ACK", 0x10, 1001, 5001, 0, ESTABLISHED, 5001},
+		{"old ACK", 0x10, 1001, 4000, 0, ESTABLISHED, 5001},
+		{"ACK of unsent data", 0x10, 1001, 5007, 0x10, ESTABLISHED, 5001},
+		{"no ACK", 0x08, 1001, 0, 0, ESTABLISHED, 5001},
+		{"RST without ACK", 0x04, 1001, 0, 0, CLOSED, 5001},
+		{"RST with unacceptable ACK", 0x14, 1001, 5007, 0, CLOSED, 5001},
+		{"RST in window", 0x04, 1500, 0, 0, CLOSED, 5001},
+		{"RST outside window", 0x04, 9000, 0, 0, ESTABLISHED, 5001},
+		{"SYN", 0x02, 1001, 0, 0x10, ESTABLISHED, 5001},
+		{"SYN-ACK", 0x12, 1001, 5006, 0x10, ESTABLISHED, 5001},
+	}
+
+	for _, test := range tests {
+		c, _ := handshake(t)
+		final := &TCP{SourcePort: 40000, DestinationPort: 80, SequenceNumber: 1001, AcknowledgmentNumber: 5001, ControlBits: 0x10, Window: 1024}
+		if _, err := c.HandleSegment(final, bytes.NewReader(nil)); err != nil {
+			t.Fatal(err)
+		}
+
+		// Five bytes in flight, SND.UNA = 5001, SND.NXT = 5006
+		c.sendBuffer = []byte("hello")
+		c.SendNext = c.SendNext.Add(5)
+
+		segment := &TCP{SourcePort: 40000, DestinationPort: 80, SequenceNumber: test.seq, AcknowledgmentNumber: test.ack, ControlBits: test.flags, Window: 1024}
+		response, err := c.HandleSegment(segment, bytes.NewReader(nil))
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		if response.ControlBits != test.wantFlags {
+			t.Errorf("%s: response flags %#x, want %#x", test.name, response.ControlBits, test.wantFlags)
+		}
+		if c.State != test.wantState {
+			t.Errorf("%s: state %s, want %s", test.name, c.State, test.wantState)
+		}
+		if c.SendUnacknowledged != test.wantUna {
+			t.Errorf("%s: SND.UNA %d, want %d", test.name, c.SendUnacknowledged, test.wantUna)
+		}
+		if want := int(c.SendNext.Diff(c.SendUnacknowledged)); len(c.sendBuffer) != want {
+			t.Errorf("%s: %d bytes buffered, want %d", test.name, len(c.sendBuffer), want)
+		}
+	}
+}
+
+func TestReceiveWindow(t *testing.T) {
+	c, _ := handshake(t)
+	final := &TCP{SourcePort: 40000, DestinationPort: 80, SequenceNumber: 1001, AcknowledgmentNumber: 5001, ControlBits: 0x10, Window: 1024}
+	if _, err := c.HandleSegment(final, bytes.NewReader(nil)); err != nil {
+		t.Fatal(err)
+	}
+
+	send := func(seq uint32, flags uint8, n int) TCP {
+		segment := &TCP{SourcePort: 40000, DestinationPort: 80, SequenceNumber: seq, AcknowledgmentNumber: 5001, ControlBits: 0x10 | flags, Window: 1024}
+		response, err := c.HandleSegment(segment, bytes.NewReader(make([]byte, n)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return response
+	}
+
+	response := send(1001, 0, 1000)
+	if response.Window != READ_BUFFER_BYTES-1000 || c.ReceiveNext != 2001 {
+		t.Errorf("after 1000 bytes, window %d and RCV.NXT %d", response.Window, c.ReceiveNext)
+	}
+
+	// Only what fits is taken, and the FIN after it isn't
+	response = send(2001, 0x01, 100)
+	if response.Window != 0 || c.ReceiveNext != 1001+READ_BUFFER_BYTES || c.State != ESTABLISHED {
+		t.Errorf("after overflowing, window %d, RCV.NXT %d, state %s", response.Window, c.ReceiveNext, c.State)
+	}
+
+	// A zero window probe is refused until the user reads
+	response = send(uint32(c.ReceiveNext), 0, 1)
+	if response.Window != 0 || c.ReceiveNext != 1001+READ_BUFFER_BYTES {
+		t.Errorf("zero window probe taken: window %d, RCV.NXT %d", response.Window, c.ReceiveNext)
+	}
+
+	c.Read(make([]byte, 512))
+	response = send(uint32(c.ReceiveNext), 0, 1)
+	if response.Window != 511 || c.ReceiveNext != 1002+READ_BUFFER_BYTES {
+		t.Errorf("after reading 512 bytes, window %d, RCV.NXT %d", response.Window, c.ReceiveNext)
+	}
+}
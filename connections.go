@@ -0,0 +1,439 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// HISTORY_SIZE is how many removed connections are remembered for the REPL.
+const HISTORY_SIZE = 32
+
+type Connections struct {
+	mu sync.Mutex
+
+	m         map[Quad]*Connection
+	ids       map[int]Quad
+	nextID    int
+	listeners map[uint16]*Listener
+
+	// Recently removed connections, oldest first
+	history []ClosedConnection
+
+	isn       *ISNGenerator
+	cookies   *SynCookies
+	events    *EventBus
+	out       *IPOutput
+	pmtu      *PathMTUCache
+	ping      *Pinger
+	neighbors *NeighborDiscovery
+	udp       *UDPEndpoints
+
+	// Queue sizes for listeners that haven't been configured explicitly
+	SynBacklog, AcceptBacklog int
+
+	// Whether new connections run packetization layer path MTU discovery
+	PLPMTUD bool
+
+	// The Ethernet link in TAP mode, or nil on a TUN device
+	Link *EthernetLink
+
+	Capture *CaptureLink
+
+	// Whether every segment is traced, rather than just those on connections
+	// with tracing turned on
+	Trace bool
+}
+
+// ClosedConnection records a connection that has been removed from the table.
+type ClosedConnection struct {
+	ID       int
+	Quad     Quad
+	State    ConnectionState
+	ClosedAt time.Time
+
+	// Why the connection was removed, if it didn't close normally
+	Reason error
+}
+
+// outgoing is a segment generated outside the packet loop, e.g. by a timer.
+type outgoing struct {
+	Quad    Quad
+	TCP     TCP
+	Payload []byte
+}
+
+func NewConnections(isn *ISNGenerator, cookies *SynCookies, out *IPOutput, ping *Pinger, neighbors *NeighborDiscovery, udp *UDPEndpoints, synBacklog, acceptBacklog int) *Connections {
+	return &Connections{
+		m:             make(map[Quad]*Connection),
+		ids:           make(map[int]Quad),
+		listeners:     make(map[uint16]*Listener),
+		isn:           isn,
+		cookies:       cookies,
+		events:        NewEventBus(),
+		out:           out,
+		pmtu:          NewPathMTUCache(),
+		ping:          ping,
+		neighbors:     neighbors,
+		udp:           udp,
+		SynBacklog:    synBacklog,
+		AcceptBacklog: acceptBacklog,
+	}
+}
+
+// newConnection allocates a connection with the next unused ID. It isn't in
+// the table until it's initialized and passed to add.
+func (c *Connections) newConnection(quad Quad) *Connection {
+	conn := &Connection{ID: c.nextID, Quad: quad, events: c.events, DontFragment: true}
+	c.nextID++
+
+	mtu := uint16(c.out.MTU)
+	if pmtu := c.pmtu.Get(quad.SourceIP, time.Now()); pmtu != 0 && pmtu < mtu {
+		mtu = pmtu
+	}
+	conn.PathMSS = mtu - headerOverhead(quad.SourceIP)
+
+	c.events.Publish(Event{Type: EventCreated, Quad: quad, ConnectionID: conn.ID})
+	return conn
+}
+
+func (c *Connections) startPLPMTUD(conn *Connection) {
+	if c.PLPMTUD {
+		conn.EnablePLPMTUD(uint16(c.out.MTU)-headerOverhead(conn.Quad.SourceIP), time.Now())
+	}
+}
+
+func (c *Connections) add(quad Quad, conn *Connection) {
+	c.m[quad] = conn
+	c.ids[conn.ID] = quad
+}
+
+// established hands a connection that has completed its handshake to the
+// application, or queues it until it's accepted.
+func (c *Connections) established(l *Listener, quad Quad, conn *Connection) {
+	if l.AutoAccept {
+		c.deliver(conn)
+		return
+	}
+	l.acceptQueue = append(l.acceptQueue, quad)
+}
+
+// deliver starts copying an accepted connection's data to stdout. Until then
+// it's only buffered.
+func (c *Connections) deliver(conn *Connection) {
+	go func() {
+		_, err := io.Copy(os.Stdout, conn)
+		if err == nil {
+			conn.Logger().Info("peer closed the connection")
+		} else if err != ErrConnectionAborted {
+			conn.Logger().Warn("failed to read from connection", "err", err)
+		}
+	}()
+}
+
+// remove discards a connection. reason is nil if it closed normally.
+func (c *Connections) remove(quad Quad, reason error) {
+	conn, ok := c.m[quad]
+	if !ok {
+		return
+	}
+
+	if reason != nil {
+		conn.Logger().Warn("connection removed", "reason", reason)
+	}
+
+	conn.Abort(reason)
+
+	c.history = append(c.history, ClosedConnection{
+		ID: conn.ID, Quad: quad, State: conn.GetState(), ClosedAt: time.Now(), Reason: reason,
+	})
+	if len(c.history) > HISTORY_SIZE {
+		c.history = c.history[len(c.history)-HISTORY_SIZE:]
+	}
+
+	delete(c.m, quad)
+	delete(c.ids, conn.ID)
+	c.listener(quad.DestinationPort).remove(quad)
+
+	c.events.Publish(Event{Type: EventClosed, Quad: quad, ConnectionID: conn.ID})
+}
+
+// Subscribe registers for connection events. See EventBus.Subscribe.
+func (c *Connections) Subscribe(buffer int) (<-chan Event, func()) {
+	return c.events.Subscribe(buffer)
+}
+
+// listener returns the listener for a local port. Every port accepts
+// connections, so listeners are created on demand with the default queue sizes.
+func (c *Connections) listener(port uint16) *Listener {
+	l, ok := c.listeners[port]
+	if !ok {
+		l = &Listener{Port: port, SynBacklog: c.SynBacklog, AcceptBacklog: c.AcceptBacklog, AutoAccept: true}
+		c.listeners[port] = l
+	}
+	return l
+}
+
+func (c *Connections) Get(id int) (Quad, *Connection, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	quad, ok := c.ids[id]
+	if !ok {
+		return Quad{}, nil, fmt.Errorf("no connection with id %d", id)
+	}
+
+	return quad, c.m[quad], nil
+}
+
+// Handle routes an incoming segment to its connection, creating one (or
+// answering with a SYN cookie) if there isn't one yet. A non-empty response
+// should be sent back to the peer.
+func (c *Connections) Handle(quad Quad, tcp *TCP, payload *bytes.Reader) (response TCP, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	length := payload.Len()
+
+	// Every port is listening, so a segment without a connection starts in
+	// LISTEN if it creates one and CLOSED otherwise
+	conn, existed := c.m[quad]
+	before := CLOSED
+	if existed {
+		before = conn.GetState()
+	}
+
+	response, err = c.handle(quad, tcp, payload)
+
+	after := CLOSED
+	if current, ok := c.m[quad]; ok {
+		conn = current
+		after = conn.GetState()
+		if !existed {
+			before = LISTEN
+		}
+		conn.setTracedState(after)
+	}
+
+	if c.Trace || (conn != nil && conn.getTrace()) {
+		traceSegment(now, true, quad, tcp, length, conn, before, after)
+	}
+
+	return
+}
+
+// handle does the work for Handle. The caller holds c.mu.
+func (c *Connections) handle(quad Quad, tcp *TCP, payload *bytes.Reader) (response TCP, err error) {
+	l := c.listener(quad.DestinationPort)
+	conn, ok := c.m[quad]
+
+	if !ok {
+		syn := tcp.ControlBits&0x02 == 0x02
+		ack := tcp.ControlBits&0x10 == 0x10
+
+		if syn && len(l.synQueue) >= l.SynBacklog {
+			cookie := c.cookies.Make(quad, SeqNum(tcp.SequenceNumber), tcp.MaxSegmentSize)
+			return synAck(tcp, cookie, READ_BUFFER_BYTES), nil
+		}
+
+		if !syn && ack {
+			irs := SeqNum(tcp.SequenceNumber - 1)
+			cookie := SeqNum(tcp.AcknowledgmentNumber - 1)
+			if mss, ok := c.cookies.Check(quad, irs, cookie); ok {
+				if len(l.acceptQueue) >= l.AcceptBacklog {
+					// Drop the ACK; the peer will retransmit it
+					drops.Add(tcpLog, "accept queue full", "quad", quad)
+					return
+				}
+
+				conn = c.newConnection(quad)
+				conn.InitializeFromCookie(tcp, mss)
+				c.startPLPMTUD(conn)
+				c.add(quad, conn)
+				c.established(l, quad, conn)
+				response, err = conn.HandleSegment(tcp, payload)
+				if err != nil {
+					c.remove(quad, err)
+				}
+				return
+			}
+		}
+
+		if !syn {
+			// Not a new connection, and not one we know about
+			drops.Add(tcpLog, "segment for unknown connection", "quad", quad)
+			return
+		}
+
+		conn = c.newConnection(quad)
+		conn.Initialize(tcp, c.isn.Next(quad))
+		c.startPLPMTUD(conn)
+		c.add(quad, conn)
+	}
+
+	before := conn.GetState()
+	if before == SYN_RECEIVED && len(l.acceptQueue) >= l.AcceptBacklog {
+		// Completing the handshake would overflow the accept queue, so ignore
+		// the segment and leave the SYN-ACK timer to retry
+		drops.Add(conn.Logger(), "accept queue full")
+		return
+	}
+
+	response, err = conn.HandleSegment(tcp, payload)
+	if err != nil {
+		// Error handling segment, remove connection
+		c.remove(quad, err)
+		return
+	}
+
+	after := conn.GetState()
+	if after == CLOSED {
+		c.remove(quad, nil)
+		return
+	}
+
+	if before == LISTEN && after == SYN_RECEIVED {
+		l.synQueue = append(l.synQueue, quad)
+	}
+	// The final ACK may also carry a FIN, taking the connection straight on
+	// to CLOSE-WAIT
+	if before == SYN_RECEIVED && after != SYN_RECEIVED {
+		l.synQueue = removeQuad(l.synQueue, quad)
+		c.established(l, quad, conn)
+	}
+
+	return
+}
+
+// Tick runs connection timers, returning any segments that need to be
+// (re)transmitted. Connections whose timers give up are removed.
+func (c *Connections) Tick(now time.Time) (segments []outgoing) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for quad, conn := range c.m {
+		retransmit, err := conn.Tick(quad, now)
+		if err != nil || conn.GetState() == CLOSED {
+			c.remove(quad, err)
+			continue
+		}
+
+		segments = append(segments, retransmit...)
+	}
+
+	return
+}
+
+// Accept pops the oldest established connection off a listener's accept queue,
+// starts delivering its data and returns its id.
+func (c *Connections) Accept(port uint16) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	l := c.listener(port)
+	if len(l.acceptQueue) == 0 {
+		return 0, fmt.Errorf("no connections waiting on port %d", port)
+	}
+
+	quad := l.acceptQueue[0]
+	l.acceptQueue = l.acceptQueue[1:]
+
+	conn := c.m[quad]
+	c.deliver(conn)
+	return conn.ID, nil
+}
+
+// Listen sets a port's queue sizes. From then on its connections wait in the
+// accept queue, and their data is buffered, until they're accepted.
+func (c *Connections) Listen(port uint16, synBacklog, acceptBacklog int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	l := c.listener(port)
+	l.SynBacklog = synBacklog
+	l.AcceptBacklog = acceptBacklog
+	l.AutoAccept = false
+}
+
+func (c *Connections) Inspect() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	ids := make([]int, 0, len(c.ids))
+	for id := range c.ids {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+
+	fmt.Printf("%d connections:\n", len(c.m))
+	for _, id := range ids {
+		quad := c.ids[id]
+		fmt.Printf("%d: %+v %s\n", id, quad, c.m[quad].Summary())
+	}
+}
+
+func (c *Connections) InspectHistory() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	fmt.Printf("%d recently closed connections:\n", len(c.history))
+	for _, h := range c.history {
+		fmt.Printf("%d: %+v %s (closed %s)", h.ID, h.Quad, h.State, h.ClosedAt.Format(time.StampMilli))
+		if h.Reason != nil {
+			fmt.Printf(": %s", h.Reason)
+		}
+		fmt.Println()
+	}
+}
+
+// Ping sends echo requests to destination and prints the replies.
+func (c *Connections) Ping(destination netip.Addr, count int) {
+	c.ping.Ping(destination, count)
+}
+
+// UDP returns the table of bound UDP ports.
+func (c *Connections) UDP() *UDPEndpoints {
+	return c.udp
+}
+
+func (c *Connections) InspectLink() {
+	if c.Link == nil {
+		fmt.Printf("not running on a TAP device\n")
+		return
+	}
+	c.Link.Inspect()
+}
+
+// SetTrace turns tracing of every segment on or off.
+func (c *Connections) SetTrace(trace bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.Trace = trace
+}
+
+func (c *Connections) InspectPathMTU() {
+	c.pmtu.Inspect()
+}
+
+func (c *Connections) InspectListeners() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	ports := make([]int, 0, len(c.listeners))
+	for port := range c.listeners {
+		ports = append(ports, int(port))
+	}
+	sort.Ints(ports)
+
+	fmt.Printf("%d listeners:\n", len(ports))
+	for _, port := range ports {
+		c.listeners[uint16(port)].Inspect()
+	}
+}
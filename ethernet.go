@@ -0,0 +1,298 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+const (
+	ETHERNET_HEADER_LENGTH = 14
+
+	ETHERTYPE_IPV4 = 0x0800
+	ETHERTYPE_ARP  = 0x0806
+	ETHERTYPE_IPV6 = 0x86DD
+)
+
+var ErrInvalidEthernetHeader = fmt.Errorf("failed to parse Ethernet header")
+
+var ethernetBroadcast = net.HardwareAddr{0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF}
+
+// Ethernet is an Ethernet II header.
+type Ethernet struct {
+	Destination, Source net.HardwareAddr
+	EtherType           uint16
+}
+
+func parseEthernetHeader(buf *bytes.Reader) (eth Ethernet, err error) {
+	if buf.Len() < ETHERNET_HEADER_LENGTH {
+		return eth, ErrInvalidEthernetHeader
+	}
+
+	eth.Destination = make(net.HardwareAddr, 6)
+	io.ReadFull(buf, eth.Destination)
+
+	eth.Source = make(net.HardwareAddr, 6)
+	io.ReadFull(buf, eth.Source)
+
+	err = binary.Read(buf, binary.BigEndian, &eth.EtherType)
+
+	// Values below 1536 are an 802.3 length field, not an EtherType
+	if eth.EtherType < 0x0600 {
+		return eth, ErrInvalidEthernetHeader
+	}
+	return
+}
+
+func (eth *Ethernet) Serialize() *bytes.Buffer {
+	buf := bytes.NewBuffer([]byte{})
+
+	buf.Write(eth.Destination)
+	buf.Write(eth.Source)
+	binary.Write(buf, binary.BigEndian, eth.EtherType)
+
+	return buf
+}
+
+// EthernetLink runs the stack over a TAP device. It reads and writes IP
+// packets like a TUN device does, adding and removing the Ethernet framing,
+// answering ARP requests for our address, and resolving the addresses of
+// outgoing packets. There's no routing table, so every destination is
+// assumed to be on the link.
+//
+// IPv6 neighbors aren't solicited; their addresses are learned from the
+// frames they send us.
+type EthernetLink struct {
+	mu  sync.Mutex
+	dev io.ReadWriter
+
+	HardwareAddress net.HardwareAddr
+	LocalIP         uint32
+
+	arp       *ARPCache
+	neighbors map[netip.Addr]net.HardwareAddr
+
+	// Only used by Read, which is only called from the packet loop
+	frame []byte
+}
+
+func NewEthernetLink(dev io.ReadWriter, hw net.HardwareAddr, localIP uint32, mtu int) *EthernetLink {
+	return &EthernetLink{
+		dev:             dev,
+		HardwareAddress: hw,
+		LocalIP:         localIP,
+		arp:             NewARPCache(),
+		neighbors:       make(map[netip.Addr]net.HardwareAddr),
+		frame:           make([]byte, ETHERNET_HEADER_LENGTH+mtu),
+	}
+}
+
+// Read returns the next IPv4 or IPv6 packet addressed to us, handling any ARP
+// packets that arrive first.
+func (l *EthernetLink) Read(p []byte) (int, error) {
+	for {
+		n, err := l.dev.Read(l.frame)
+		if err != nil {
+			return 0, err
+		}
+
+		reader := bytes.NewReader(l.frame[:n])
+		eth, err := parseEthernetHeader(reader)
+		if err != nil {
+			drops.Add(linkLog, err.Error())
+			continue
+		}
+
+		// On a bridge we'll see frames flooded to other hosts; only unicast
+		// frames for us and broadcasts or multicasts are ours
+		if !bytes.Equal(eth.Destination, l.HardwareAddress) && eth.Destination[0]&0x01 == 0 {
+			continue
+		}
+
+		payload := l.frame[n-reader.Len() : n]
+		if len(payload) > len(p) {
+			drops.Add(linkLog, "frame larger than the MTU", "bytes", len(payload))
+			continue
+		}
+
+		switch eth.EtherType {
+		case ETHERTYPE_ARP:
+			l.handleARP(payload)
+
+		case ETHERTYPE_IPV4:
+			return copy(p, payload), nil
+
+		case ETHERTYPE_IPV6:
+			if len(payload) >= IPV6_HEADER_LENGTH {
+				var source [16]byte
+				copy(source[:], payload[8:24])
+				l.learnNeighbor(netip.AddrFrom16(source), eth.Source)
+			}
+			return copy(p, payload), nil
+
+		default:
+			drops.Add(linkLog, "unknown EtherType", "ethertype", eth.EtherType)
+		}
+	}
+}
+
+// Write sends an IP packet, framing it for the link. If the destination's
+// Ethernet address isn't known yet, the packet is held while it's resolved,
+// so a successful Write doesn't mean the packet has been sent.
+func (l *EthernetLink) Write(packet []byte) (int, error) {
+	if len(packet) == 0 {
+		return 0, nil
+	}
+
+	now := time.Now()
+
+	if packet[0]>>4 == 6 {
+		if len(packet) < IPV6_HEADER_LENGTH {
+			return 0, ErrInvalidIPv6Header
+		}
+
+		var destination [16]byte
+		copy(destination[:], packet[24:40])
+
+		hw := l.neighbor(netip.AddrFrom16(destination))
+		if hw == nil {
+			drops.Add(linkLog, "unknown IPv6 neighbor", "dst", netip.AddrFrom16(destination))
+			return len(packet), nil
+		}
+
+		return len(packet), l.send(hw, ETHERTYPE_IPV6, packet)
+	}
+
+	if len(packet) < IP_MIN_HEADER_LENGTH*4 {
+		return 0, ErrInvalidIPHeader
+	}
+
+	destination := binary.BigEndian.Uint32(packet[16:])
+	if destination == 0xFFFFFFFF {
+		return len(packet), l.send(ethernetBroadcast, ETHERTYPE_IPV4, packet)
+	}
+
+	hw := l.arp.Lookup(destination, now)
+	if hw == nil {
+		if l.arp.Queue(destination, packet, now) {
+			return len(packet), l.request(destination)
+		}
+		return len(packet), nil
+	}
+
+	return len(packet), l.send(hw, ETHERTYPE_IPV4, packet)
+}
+
+func (l *EthernetLink) send(destination net.HardwareAddr, etherType uint16, payload []byte) error {
+	eth := Ethernet{Destination: destination, Source: l.HardwareAddress, EtherType: etherType}
+	frame := eth.Serialize()
+	frame.Write(payload)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	_, err := frame.WriteTo(l.dev)
+	return err
+}
+
+// request broadcasts an ARP request for addr.
+func (l *EthernetLink) request(addr uint32) error {
+	arp := ARP{
+		HardwareType: ARP_HARDWARE_ETHERNET, ProtocolType: ETHERTYPE_IPV4,
+		HardwareLength: 6, ProtocolLength: 4,
+		Operation:             ARP_REQUEST,
+		SenderHardwareAddress: l.HardwareAddress, SenderProtocolAddress: l.LocalIP,
+		TargetHardwareAddress: make(net.HardwareAddr, 6), TargetProtocolAddress: addr,
+	}
+
+	return l.send(ethernetBroadcast, ETHERTYPE_ARP, arp.Serialize().Bytes())
+}
+
+// handleARP follows the packet reception algorithm from RFC 826.
+func (l *EthernetLink) handleARP(payload []byte) {
+	arp, err := parseARP(bytes.NewReader(payload))
+	if err != nil {
+		drops.Add(linkLog, err.Error())
+		return
+	}
+
+	now := time.Now()
+	forUs := arp.TargetProtocolAddress == l.LocalIP
+
+	// Learn the sender's address if it's talking to us, or refresh it if we
+	// already knew it; then send anything that was waiting for it
+	for _, packet := range l.arp.Update(arp.SenderProtocolAddress, arp.SenderHardwareAddress, forUs, now) {
+		err := l.send(arp.SenderHardwareAddress, ETHERTYPE_IPV4, packet)
+		if err != nil {
+			linkLog.Error("failed to send queued packet", "err", err)
+		}
+	}
+
+	if !forUs || arp.Operation != ARP_REQUEST {
+		return
+	}
+
+	reply := arp
+	reply.Operation = ARP_REPLY
+	reply.SenderHardwareAddress, reply.TargetHardwareAddress = l.HardwareAddress, arp.SenderHardwareAddress
+	reply.SenderProtocolAddress, reply.TargetProtocolAddress = l.LocalIP, arp.SenderProtocolAddress
+
+	err = l.send(arp.SenderHardwareAddress, ETHERTYPE_ARP, reply.Serialize().Bytes())
+	if err != nil {
+		linkLog.Error("failed to send ARP reply", "err", err)
+	}
+}
+
+func (l *EthernetLink) learnNeighbor(addr netip.Addr, hw net.HardwareAddr) {
+	if !addr.IsGlobalUnicast() && !addr.IsLinkLocalUnicast() {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.neighbors[addr] = append(net.HardwareAddr{}, hw...)
+}
+
+// neighbor returns the Ethernet address for an IPv6 destination, mapping
+// multicast addresses as RFC 2464 §7 describes.
+func (l *EthernetLink) neighbor(addr netip.Addr) net.HardwareAddr {
+	if addr.IsMulticast() {
+		b := addr.As16()
+		return net.HardwareAddr{0x33, 0x33, b[12], b[13], b[14], b[15]}
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.neighbors[addr]
+}
+
+// timers retransmits unanswered ARP requests.
+func (l *EthernetLink) timers() {
+	for now := range time.Tick(TIMER_GRANULARITY) {
+		for _, addr := range l.arp.Tick(now) {
+			err := l.request(addr)
+			if err != nil {
+				linkLog.Error("failed to send ARP request", "addr", addrFromUint32(addr), "err", err)
+			}
+		}
+	}
+}
+
+func (l *EthernetLink) Inspect() {
+	l.arp.Inspect()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	fmt.Printf("%d IPv6 neighbors:\n", len(l.neighbors))
+	for addr, hw := range l.neighbors {
+		fmt.Printf("%s: %s\n", addr, hw)
+	}
+}
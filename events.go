@@ -0,0 +1,147 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+type EventType uint8
+
+const (
+	EventCreated EventType = iota
+	EventStateChanged
+	EventDataReceived
+	EventWindowChanged
+	EventRetransmission
+	EventReset
+	EventClosed
+	EventUrgentData
+)
+
+var eventNames = map[EventType]string{
+	EventCreated:        "created",
+	EventStateChanged:   "state-changed",
+	EventDataReceived:   "data-received",
+	EventWindowChanged:  "window-changed",
+	EventRetransmission: "retransmission",
+	EventReset:          "reset",
+	EventClosed:         "closed",
+	EventUrgentData:     "urgent-data",
+}
+
+func (t EventType) String() string {
+	if name, ok := eventNames[t]; ok {
+		return name
+	}
+	return fmt.Sprintf("EventType(%d)", uint8(t))
+}
+
+// Event describes something that happened to a connection. Only the fields
+// relevant to Type are set.
+type Event struct {
+	Type         EventType
+	Time         time.Time
+	Quad         Quad
+	ConnectionID int
+
+	// EventStateChanged
+	OldState, NewState ConnectionState
+
+	// EventDataReceived, and EventUrgentData for the bytes up to the urgent mark
+	Bytes int
+
+	// EventWindowChanged
+	OldWindow, NewWindow uint16
+}
+
+func (e Event) String() string {
+	s := fmt.Sprintf("%s connection %d %s", e.Time.Format(time.StampMicro), e.ConnectionID, e.Type)
+	switch e.Type {
+	case EventStateChanged:
+		s += fmt.Sprintf(" %s -> %s", e.OldState, e.NewState)
+	case EventDataReceived:
+		s += fmt.Sprintf(" %d bytes", e.Bytes)
+	case EventUrgentData:
+		s += fmt.Sprintf(" %d bytes pending", e.Bytes)
+	case EventWindowChanged:
+		s += fmt.Sprintf(" %d -> %d", e.OldWindow, e.NewWindow)
+	}
+	return s
+}
+
+// EventBus fans connection events out to subscribers. Publishing never blocks:
+// if a subscriber's channel is full, the event is dropped for that subscriber
+// and counted instead, so a slow consumer can't stall the packet loop.
+type EventBus struct {
+	mu          sync.Mutex
+	subscribers map[int]*subscriber
+	nextID      int
+}
+
+type subscriber struct {
+	ch      chan Event
+	dropped uint64
+}
+
+func NewEventBus() *EventBus {
+	return &EventBus{subscribers: make(map[int]*subscriber)}
+}
+
+// Subscribe returns a channel of events with room for buffer pending events,
+// and a function that unsubscribes and closes the channel.
+func (b *EventBus) Subscribe(buffer int) (<-chan Event, func()) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	id := b.nextID
+	b.nextID++
+
+	s := &subscriber{ch: make(chan Event, buffer)}
+	b.subscribers[id] = s
+
+	var once sync.Once
+	unsubscribe := func() {
+		once.Do(func() {
+			b.mu.Lock()
+			defer b.mu.Unlock()
+
+			delete(b.subscribers, id)
+			close(s.ch)
+		})
+	}
+
+	return s.ch, unsubscribe
+}
+
+// Dropped returns the total number of events dropped across all subscribers.
+func (b *EventBus) Dropped() (n uint64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for _, s := range b.subscribers {
+		n += s.dropped
+	}
+	return
+}
+
+func (b *EventBus) Publish(e Event) {
+	if b == nil {
+		return
+	}
+
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for _, s := range b.subscribers {
+		select {
+		case s.ch <- e:
+		default:
+			s.dropped++
+		}
+	}
+}
@@ -1,6 +1,6 @@
 module tcp
 
-go 1.18
+go 1.21
 
 require (
 	github.com/songgao/packets v0.0.0-20160404182456-549a10cd4091
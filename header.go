@@ -4,41 +4,114 @@ import (
 	"bytes"
 	"encoding/binary"
 	"fmt"
+	"net/netip"
 )
 
 type IP struct {
 	Version, HeaderLength, TypeOfService, Flags, TimeToLive, Protocol uint8
 	TotalLength, Identification, FragmentOffset, HeaderChecksum       uint16
 	SourceAddress, DestinationAddress                                 uint32
+
+	Options []IPOption
+}
+
+const (
+	IP_OPTION_END_OF_LIST   = 0
+	IP_OPTION_NOP           = 1
+	IP_OPTION_RECORD_ROUTE  = 7
+	IP_OPTION_TIMESTAMP     = 68
+	IP_MIN_HEADER_LENGTH    = 5
+	IP_TIMESTAMP_ONLY       = 0
+	IP_TIMESTAMP_WITH_ADDRS = 1
+)
+
+// IPOption is a single IPv4 option. Record Route and Timestamp are decoded
+// into their own fields; any other option keeps its raw contents in Data.
+type IPOption struct {
+	Type uint8
+
+	// Record Route and Timestamp: the 1-based offset of the next free slot
+	Pointer uint8
+
+	// Record Route
+	Route []uint32
+
+	// Timestamp
+	Overflow, Flags uint8
+	Timestamps      []IPTimestamp
+
+	Data []byte
+}
+
+type IPTimestamp struct {
+	// Only set when the option's flags include addresses
+	Address   uint32
+	Timestamp uint32
+}
+
+// serialize encodes the option, including its type and length octets.
+func (o *IPOption) serialize() []byte {
+	if o.Type == IP_OPTION_END_OF_LIST || o.Type == IP_OPTION_NOP {
+		return []byte{o.Type}
+	}
+
+	body := bytes.NewBuffer([]byte{})
+
+	switch o.Type {
+	case IP_OPTION_RECORD_ROUTE:
+		body.WriteByte(o.Pointer)
+		for _, addr := range o.Route {
+			binary.Write(body, binary.BigEndian, addr)
+		}
+	case IP_OPTION_TIMESTAMP:
+		body.WriteByte(o.Pointer)
+		body.WriteByte(o.Overflow<<4 | o.Flags)
+		for _, ts := range o.Timestamps {
+			if o.Flags != IP_TIMESTAMP_ONLY {
+				binary.Write(body, binary.BigEndian, ts.Address)
+			}
+			binary.Write(body, binary.BigEndian, ts.Timestamp)
+		}
+	default:
+		body.Write(o.Data)
+	}
+
+	return append([]byte{o.Type, uint8(body.Len() + 2)}, body.Bytes()...)
+}
+
+// serializeOptions encodes all options, padded to a multiple of 4 bytes.
+func (ip *IP) serializeOptions() []byte {
+	options := []byte{}
+	for i := range ip.Options {
+		options = append(options, ip.Options[i].serialize()...)
+	}
+
+	for len(options)%4 != 0 {
+		options = append(options, IP_OPTION_END_OF_LIST)
+	}
+
+	return options
 }
 
 func (ip *IP) CalcChecksum() uint16 {
-	var temp1, temp2 uint16
-	temp1 |= uint16(ip.Version) << 12
-	temp1 |= uint16(ip.HeaderLength) << 8
-	temp1 |= uint16(ip.TypeOfService)
-
-	temp2 |= uint16(ip.Flags) << 13
-	temp2 |= uint16(ip.FragmentOffset)
-
-	sum := uint16(0)
-	sum = add1sComplement(sum, temp1)
-	sum = add1sComplement(sum, ip.TotalLength)
-	sum = add1sComplement(sum, ip.Identification)
-	sum = add1sComplement(sum, temp2)
-	sum = add1sComplement(sum, uint16(ip.TimeToLive)<<8)
-	sum = add1sComplement(sum, uint16(ip.Protocol))
-	sum = add1sComplement(sum, uint16(ip.SourceAddress>>16))
-	sum = add1sComplement(sum, uint16(ip.SourceAddress&0xFFFF))
-	sum = add1sComplement(sum, uint16(ip.DestinationAddress>>16))
-	sum = add1sComplement(sum, uint16(ip.DestinationAddress&0xFFFF))
+	checksum := ip.HeaderChecksum
+	ip.HeaderChecksum = 0
+	header := ip.serialize()
+	ip.HeaderChecksum = checksum
 
-	return ^sum
+	return ^add1sComplementBytes(0, header.Bytes())
 }
 
+// Serialize encodes the header and options, setting HeaderLength and
+// HeaderChecksum to match. TotalLength must already account for the options.
 func (ip *IP) Serialize() *bytes.Buffer {
-	buf := bytes.NewBuffer([]byte{})
+	ip.HeaderLength = IP_MIN_HEADER_LENGTH + uint8(len(ip.serializeOptions())/4)
 	ip.HeaderChecksum = ip.CalcChecksum()
+	return ip.serialize()
+}
+
+func (ip *IP) serialize() *bytes.Buffer {
+	buf := bytes.NewBuffer([]byte{})
 
 	var temp uint16
 	temp |= uint16(ip.Version) << 12
@@ -59,6 +132,7 @@ func (ip *IP) Serialize() *bytes.Buffer {
 	binary.Write(buf, binary.BigEndian, ip.HeaderChecksum)
 	binary.Write(buf, binary.BigEndian, ip.SourceAddress)
 	binary.Write(buf, binary.BigEndian, ip.DestinationAddress)
+	buf.Write(ip.serializeOptions())
 
 	return buf
 }
@@ -77,26 +151,58 @@ func (ip *IP) Inspect() {
 	fmt.Printf("Header checksum: %d\n", ip.HeaderChecksum)
 	fmt.Printf("Source IP:       %s\n", formatIPAddress(ip.SourceAddress))
 	fmt.Printf("Dest IP:         %s\n", formatIPAddress(ip.DestinationAddress))
+
+	for _, o := range ip.Options {
+		switch o.Type {
+		case IP_OPTION_END_OF_LIST, IP_OPTION_NOP:
+		case IP_OPTION_RECORD_ROUTE:
+			route := []string{}
+			for _, addr := range o.Route {
+				route = append(route, formatIPAddress(addr))
+			}
+			fmt.Printf("Record route:    %s (pointer %d)\n", route, o.Pointer)
+		case IP_OPTION_TIMESTAMP:
+			fmt.Printf("Timestamp:       %+v (pointer %d, overflow %d, flags %d)\n", o.Timestamps, o.Pointer, o.Overflow, o.Flags)
+		default:
+			fmt.Printf("Option %-3d       %x\n", o.Type, o.Data)
+		}
+	}
 }
 
 type TCP struct {
 	DataOffset, Reserved, ControlBits                            uint8
 	SourcePort, DestinationPort, Window, Checksum, UrgentPointer uint16
 	SequenceNumber, AcknowledgmentNumber                         uint32
+
+	// Options
+	MaxSegmentSize uint16
+}
+
+// serializeOptions encodes the options that are set, padded to a multiple of 4
+// bytes.
+func (t *TCP) serializeOptions() []byte {
+	options := []byte{}
+	if t.MaxSegmentSize != 0 {
+		options = append(options, 2, 4, byte(t.MaxSegmentSize>>8), byte(t.MaxSegmentSize))
+	}
+
+	for len(options)%4 != 0 {
+		options = append(options, 0) // End of option list
+	}
+
+	return options
 }
 
-func (t *TCP) CalcChecksum(ip *IP, payload []byte) uint16 {
+// CalcChecksum computes the checksum over the segment, including its options,
+// and the IPv4 or IPv6 pseudo-header for the given addresses.
+func (t *TCP) CalcChecksum(source, destination netip.Addr, payload []byte) uint16 {
+	options := t.serializeOptions()
+
 	var temp uint16
-	temp |= uint16(t.DataOffset) << 12
+	temp |= uint16(5+len(options)/4) << 12
 	temp |= uint16(t.ControlBits)
 
-	sum := uint16(0)
-	sum = add1sComplement(sum, uint16(ip.SourceAddress>>16))
-	sum = add1sComplement(sum, uint16(ip.SourceAddress&0xFFFF))
-	sum = add1sComplement(sum, uint16(ip.DestinationAddress>>16))
-	sum = add1sComplement(sum, uint16(ip.DestinationAddress&0xFFFF))
-	sum = add1sComplement(sum, uint16(ip.Protocol))
-	sum = add1sComplement(sum, uint16(20+len(payload)))
+	sum := pseudoHeaderSum(source, destination, 6, 20+len(options)+len(payload))
 	sum = add1sComplement(sum, t.SourcePort)
 	sum = add1sComplement(sum, t.DestinationPort)
 	sum = add1sComplement(sum, uint16(t.SequenceNumber>>16))
@@ -107,25 +213,25 @@ func (t *TCP) CalcChecksum(ip *IP, payload []byte) uint16 {
 	sum = add1sComplement(sum, t.Window)
 	sum = add1sComplement(sum, t.UrgentPointer)
 
-	for i := 0; i < len(payload)/2; i++ {
-		sum = add1sComplement(sum, uint16(payload[i*2])<<8+uint16(payload[(i*2)+1]))
-	}
-
-	if len(payload)%2 != 0 {
-		sum = add1sComplement(sum, uint16(payload[len(payload)-1])<<8+uint16(0x00))
-	}
+	sum = add1sComplementBytes(sum, options)
+	sum = add1sComplementBytes(sum, payload)
 
 	return ^sum
 }
 
-func (t *TCP) Serialize(ip *IP, payload []byte) *bytes.Buffer {
+// Serialize encodes the header, options and payload, setting DataOffset and
+// Checksum to match.
+func (t *TCP) Serialize(source, destination netip.Addr, payload []byte) *bytes.Buffer {
 	buf := bytes.NewBuffer([]byte{})
 
+	options := t.serializeOptions()
+	t.DataOffset = uint8(5 + len(options)/4)
+
 	var temp uint16
 	temp |= uint16(t.DataOffset) << 12
 	temp |= uint16(t.ControlBits)
 
-	t.Checksum = t.CalcChecksum(ip, payload)
+	t.Checksum = t.CalcChecksum(source, destination, payload)
 
 	binary.Write(buf, binary.BigEndian, t.SourcePort)
 	binary.Write(buf, binary.BigEndian, t.DestinationPort)
@@ -135,6 +241,7 @@ func (t *TCP) Serialize(ip *IP, payload []byte) *bytes.Buffer {
 	binary.Write(buf, binary.BigEndian, t.Window)
 	binary.Write(buf, binary.BigEndian, t.Checksum)
 	binary.Write(buf, binary.BigEndian, t.UrgentPointer)
+	buf.Write(options)
 
 	buf.Write(payload)
 
@@ -173,4 +280,7 @@ func (tcp *TCP) Inspect() {
 	fmt.Printf("Window:                 %d\n", tcp.Window)
 	fmt.Printf("Checksum:               %d\n", tcp.Checksum)
 	fmt.Printf("Urgent pointer:         %d\n", tcp.UrgentPointer)
+	if tcp.MaxSegmentSize != 0 {
+		fmt.Printf("MSS:                    %d\n", tcp.MaxSegmentSize)
+	}
 }
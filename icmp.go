@@ -0,0 +1,327 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net/netip"
+)
+
+const (
+	ICMP_ECHO_REPLY              = 0
+	ICMP_DESTINATION_UNREACHABLE = 3
+	ICMP_ECHO_REQUEST            = 8
+	ICMP_TIME_EXCEEDED           = 11
+
+	// Destination unreachable codes
+	ICMP_NET_UNREACHABLE      = 0
+	ICMP_HOST_UNREACHABLE     = 1
+	ICMP_PROTOCOL_UNREACHABLE = 2
+	ICMP_PORT_UNREACHABLE     = 3
+	ICMP_FRAGMENTATION_NEEDED = 4
+)
+
+var ErrInvalidICMPHeader = fmt.Errorf("failed to parse ICMP header")
+
+var ErrNetUnreachable = fmt.Errorf("network unreachable")
+var ErrHostUnreachable = fmt.Errorf("host unreachable")
+var ErrProtocolUnreachable = fmt.Errorf("protocol unreachable")
+var ErrPortUnreachable = fmt.Errorf("port unreachable")
+var ErrDestinationUnreachable = fmt.Errorf("destination unreachable")
+var ErrTimeExceeded = fmt.Errorf("time exceeded")
+
+// hardErrors are the errors RFC 1122 §4.2.3.9 says should abort a connection:
+// the peer is reachable but isn't running TCP, or nothing is listening on the
+// port. Everything else is soft, since the route may recover. (Fragmentation
+// needed is a hard error too, but it's handled by path MTU discovery.) RFC
+// 5927 §4.1 only aborts on them during the handshake, since ICMP is easily
+// forged.
+var hardErrors = map[error]bool{
+	ErrProtocolUnreachable: true,
+	ErrPortUnreachable:     true,
+}
+
+var unreachableErrors = map[uint8]error{
+	ICMP_NET_UNREACHABLE:      ErrNetUnreachable,
+	ICMP_HOST_UNREACHABLE:     ErrHostUnreachable,
+	ICMP_PROTOCOL_UNREACHABLE: ErrProtocolUnreachable,
+	ICMP_PORT_UNREACHABLE:     ErrPortUnreachable,
+}
+
+// Error maps a destination unreachable or time exceeded message to the error
+// reported to the user if the connection it refers to times out.
+func (icmp *ICMP) Error() error {
+	if icmp.Type == ICMP_TIME_EXCEEDED {
+		return ErrTimeExceeded
+	}
+	if err, ok := unreachableErrors[icmp.Code]; ok {
+		return err
+	}
+	return ErrDestinationUnreachable
+}
+
+type ICMP struct {
+	Type, Code uint8
+	Checksum   uint16
+
+	// The second word of the header, whose meaning depends on the type
+	Rest uint32
+}
+
+// NextHopMTU is the MTU reported in a fragmentation needed message (RFC 1191).
+// Older routers leave it as zero.
+func (icmp *ICMP) NextHopMTU() uint16 {
+	return uint16(icmp.Rest & 0xFFFF)
+}
+
+// Identifier and Sequence are the second word of an echo request or reply.
+func (icmp *ICMP) Identifier() uint16 {
+	return uint16(icmp.Rest >> 16)
+}
+
+func (icmp *ICMP) Sequence() uint16 {
+	return uint16(icmp.Rest & 0xFFFF)
+}
+
+func (icmp *ICMP) CalcChecksum(payload []byte) uint16 {
+	return icmp.checksum(0, payload)
+}
+
+// CalcChecksumIPv6 computes an ICMPv6 checksum, which unlike ICMP's also covers
+// the IPv6 pseudo-header (RFC 4443 §2.3).
+func (icmp *ICMP) CalcChecksumIPv6(source, destination netip.Addr, payload []byte) uint16 {
+	return icmp.checksum(pseudoHeaderSum(source, destination, IPV6_NEXT_HEADER_ICMPV6, 8+len(payload)), payload)
+}
+
+func (icmp *ICMP) checksum(sum uint16, payload []byte) uint16 {
+	sum = add1sComplement(sum, uint16(icmp.Type)<<8|uint16(icmp.Code))
+	sum = add1sComplement(sum, uint16(icmp.Rest>>16))
+	sum = add1sComplement(sum, uint16(icmp.Rest&0xFFFF))
+
+	sum = add1sComplementBytes(sum, payload)
+
+	return ^sum
+}
+
+func (icmp *ICMP) Serialize(payload []byte) *bytes.Buffer {
+	icmp.Checksum = icmp.CalcChecksum(payload)
+	return icmp.serialize(payload)
+}
+
+func (icmp *ICMP) SerializeIPv6(source, destination netip.Addr, payload []byte) *bytes.Buffer {
+	icmp.Checksum = icmp.CalcChecksumIPv6(source, destination, payload)
+	return icmp.serialize(payload)
+}
+
+func (icmp *ICMP) serialize(payload []byte) *bytes.Buffer {
+	buf := bytes.NewBuffer([]byte{})
+
+	buf.WriteByte(icmp.Type)
+	buf.WriteByte(icmp.Code)
+	binary.Write(buf, binary.BigEndian, icmp.Checksum)
+	binary.Write(buf, binary.BigEndian, icmp.Rest)
+
+	buf.Write(payload)
+
+	return buf
+}
+
+func parseICMPHeader(buf *bytes.Reader) (icmp ICMP, err error) {
+	/*
+	    0                   1                   2                   3
+	    0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1
+	   +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+	   |     Type      |     Code      |          Checksum             |
+	   +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+	   |                     (depends on type)                         |
+	   +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+	**/
+
+	icmp.Type, err = buf.ReadByte()
+	if err != nil {
+		return
+	}
+
+	icmp.Code, err = buf.ReadByte()
+	if err != nil {
+		return
+	}
+
+	err = binary.Read(buf, binary.BigEndian, &icmp.Checksum)
+	if err != nil {
+		return
+	}
+
+	err = binary.Read(buf, binary.BigEndian, &icmp.Rest)
+	return
+}
+
+func verifyICMPChecksum(message []byte) bool {
+	return add1sComplementBytes(0, message) == 0xFFFF
+}
+
+// quotedSegment is the part of one of our own TCP segments that's quoted back
+// in an ICMP error: the IP header and the first 8 bytes of the TCP header.
+type quotedSegment struct {
+	IP             IP
+	Quad           Quad
+	SequenceNumber SeqNum
+}
+
+// parseQuotedSegment parses the datagram quoted in an ICMP error. The quote is
+// usually truncated, so it can't go through parseIPHeader's length checks.
+func parseQuotedSegment(data []byte) (q quotedSegment, err error) {
+	if len(data) < IP_MIN_HEADER_LENGTH*4 {
+		return q, ErrInvalidICMPHeader
+	}
+
+	q.IP.Version = data[0] >> 4
+	q.IP.HeaderLength = data[0] & 0x0F
+	q.IP.TotalLength = binary.BigEndian.Uint16(data[2:])
+	q.IP.Protocol = data[9]
+	q.IP.SourceAddress = binary.BigEndian.Uint32(data[12:])
+	q.IP.DestinationAddress = binary.BigEndian.Uint32(data[16:])
+
+	headerLength := int(q.IP.HeaderLength) * 4
+	if q.IP.Version != 4 || q.IP.Protocol != 6 || headerLength < IP_MIN_HEADER_LENGTH*4 || len(data) < headerLength+8 {
+		return q, ErrInvalidICMPHeader
+	}
+
+	q.setSegment(addrFromUint32(q.IP.SourceAddress), addrFromUint32(q.IP.DestinationAddress), data[headerLength:])
+	return q, nil
+}
+
+// setSegment fills in the quad and sequence number from the quoted segment's
+// addresses and the first 8 bytes of its TCP header.
+func (q *quotedSegment) setSegment(source, destination netip.Addr, tcp []byte) {
+	// We sent the quoted segment, so its source is our end of the quad
+	q.Quad = Quad{
+		SourceIP: destination, DestinationIP: source,
+		SourcePort: binary.BigEndian.Uint16(tcp[2:]), DestinationPort: binary.BigEndian.Uint16(tcp[0:]),
+	}
+	q.SequenceNumber = SeqNum(binary.BigEndian.Uint32(tcp[4:]))
+}
+
+// sendICMP sends an ICMP or ICMPv6 message, depending on the address family.
+func sendICMP(out *IPOutput, source, destination netip.Addr, ttl uint8, icmp ICMP, payload []byte) error {
+	if destination.Is6() {
+		return out.SendIPv6(IPv6{
+			HopLimit:           ttl,
+			NextHeader:         IPV6_NEXT_HEADER_ICMPV6,
+			SourceAddress:      source,
+			DestinationAddress: destination,
+		}, icmp.SerializeIPv6(source, destination, payload).Bytes())
+	}
+
+	return out.Send(IP{
+		TimeToLive:         ttl,
+		Protocol:           1,
+		SourceAddress:      addrToUint32(source),
+		DestinationAddress: addrToUint32(destination),
+	}, icmp.Serialize(payload).Bytes())
+}
+
+// handleICMP processes an ICMP message addressed to the stack.
+func handleICMP(ip *IP, message []byte, connections *Connections) {
+	if !verifyICMPChecksum(message) {
+		drops.Add(parseLog, "bad ICMP checksum", "src", addrFromUint32(ip.SourceAddress))
+		return
+	}
+
+	reader := bytes.NewReader(message)
+	icmp, err := parseICMPHeader(reader)
+	if err != nil {
+		drops.Add(parseLog, ErrInvalidICMPHeader.Error(), "src", addrFromUint32(ip.SourceAddress))
+		return
+	}
+
+	rest := message[len(message)-reader.Len():]
+
+	source, destination := addrFromUint32(ip.SourceAddress), addrFromUint32(ip.DestinationAddress)
+
+	switch icmp.Type {
+	case ICMP_ECHO_REQUEST:
+		connections.ping.Echo(source, destination, &icmp, rest)
+		return
+	case ICMP_ECHO_REPLY:
+		connections.ping.Reply(source, ip.TimeToLive, &icmp, rest)
+		return
+	}
+
+	if icmp.Type == ICMP_DESTINATION_UNREACHABLE && icmp.Code == ICMP_FRAGMENTATION_NEEDED {
+		q, err := parseQuotedSegment(rest)
+		if err != nil {
+			drops.Add(parseLog, err.Error(), "src", source, "type", icmp.Type)
+			return
+		}
+
+		connections.FragmentationNeeded(q, icmp.NextHopMTU())
+		return
+	}
+
+	if icmp.Type == ICMP_DESTINATION_UNREACHABLE || icmp.Type == ICMP_TIME_EXCEEDED {
+		q, err := parseQuotedSegment(rest)
+		if err != nil {
+			drops.Add(parseLog, err.Error(), "src", source, "type", icmp.Type)
+			return
+		}
+
+		connections.ICMPError(q, icmp.Error())
+	}
+}
+
+// Outstanding reports whether seq is a segment we're waiting on an ACK for,
+// so that an ICMP error quoting it is plausible (RFC 5927 §4.1).
+func (c *Connection) Outstanding(seq SeqNum) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return seq.Between(c.SendUnacknowledged, c.SendNext)
+}
+
+// RecordSoftError notes an ICMP error about the segment with sequence number
+// seq. It returns false if that isn't a segment we're waiting on an ACK for.
+func (c *Connection) RecordSoftError(seq SeqNum, err error) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !seq.Between(c.SendUnacknowledged, c.SendNext) {
+		return false
+	}
+
+	c.SoftError = err
+	return true
+}
+
+// ICMPError handles a destination unreachable or time exceeded message for
+// one of our segments, following RFC 1122 §4.2.3.9. Hard errors abort the
+// connection during the handshake. Otherwise errors are soft, since the route
+// may recover; they're only reported if the connection later times out.
+// (Fragmentation needed is handled separately.)
+func (c *Connections) ICMPError(q quotedSegment, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	conn, ok := c.m[q.Quad]
+	if !ok {
+		drops.Add(tcpLog, "ICMP for unknown connection", "quad", q.Quad)
+		return
+	}
+
+	if hardErrors[err] && !conn.GetState().Synchronized() {
+		if !conn.Outstanding(q.SequenceNumber) {
+			drops.Add(conn.Logger(), "ICMP for unexpected segment", "seq", q.SequenceNumber)
+			return
+		}
+
+		c.remove(q.Quad, err)
+		return
+	}
+
+	if !conn.RecordSoftError(q.SequenceNumber, err) {
+		drops.Add(conn.Logger(), "ICMP for unexpected segment", "seq", q.SequenceNumber)
+		return
+	}
+
+	conn.Logger().Info("soft error", "err", err)
+}
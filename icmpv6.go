@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"net/netip"
+)
+
+const (
+	IPV6_NEXT_HEADER_ICMPV6 = 58
+
+	ICMPV6_DESTINATION_UNREACHABLE = 1
+	ICMPV6_PACKET_TOO_BIG          = 2
+	ICMPV6_TIME_EXCEEDED           = 3
+	ICMPV6_ECHO_REQUEST            = 128
+	ICMPV6_ECHO_REPLY              = 129
+	ICMPV6_NEIGHBOR_SOLICITATION   = 135
+	ICMPV6_NEIGHBOR_ADVERTISEMENT  = 136
+
+	// Destination unreachable codes
+	ICMPV6_NO_ROUTE            = 0
+	ICMPV6_ADDRESS_UNREACHABLE = 3
+	ICMPV6_PORT_UNREACHABLE    = 4
+
+	// Neighbor Discovery option types
+	ND_OPTION_SOURCE_LINK_ADDRESS = 1
+	ND_OPTION_TARGET_LINK_ADDRESS = 2
+
+	// Neighbor Advertisement flags
+	ND_FLAG_SOLICITED = 0x40000000
+	ND_FLAG_OVERRIDE  = 0x20000000
+
+	// RFC 4861 §7.1.1: Neighbor Discovery messages must arrive with the hop
+	// limit untouched, proving they weren't forwarded by a router
+	ND_HOP_LIMIT = 255
+)
+
+var unreachableErrorsIPv6 = map[uint8]error{
+	ICMPV6_NO_ROUTE:            ErrNetUnreachable,
+	ICMPV6_ADDRESS_UNREACHABLE: ErrHostUnreachable,
+	ICMPV6_PORT_UNREACHABLE:    ErrPortUnreachable,
+}
+
+// ErrorIPv6 is Error for ICMPv6 destination unreachable and time exceeded
+// messages, whose codes are numbered differently.
+func (icmp *ICMP) ErrorIPv6() error {
+	if icmp.Type == ICMPV6_TIME_EXCEEDED {
+		return ErrTimeExceeded
+	}
+	if err, ok := unreachableErrorsIPv6[icmp.Code]; ok {
+		return err
+	}
+	return ErrDestinationUnreachable
+}
+
+func verifyICMPv6Checksum(source, destination netip.Addr, message []byte) bool {
+	sum := pseudoHeaderSum(source, destination, IPV6_NEXT_HEADER_ICMPV6, len(message))
+	return add1sComplementBytes(sum, message) == 0xFFFF
+}
+
+// parseQuotedIPv6Segment is parseQuotedSegment for a packet quoted in an
+// ICMPv6 error.
+func parseQuotedIPv6Segment(data []byte) (q quotedSegment, err error) {
+	if len(data) < IPV6_HEADER_LENGTH || data[0]>>4 != 6 {
+		return q, ErrInvalidICMPHeader
+	}
+
+	var source, destination [16]byte
+	copy(source[:], data[8:24])
+	copy(destination[:], data[24:40])
+
+	reader := bytes.NewReader(data[IPV6_HEADER_LENGTH:])
+	protocol, err := skipExtensionHeaders(reader, data[6])
+	if err != nil || protocol != 6 || reader.Len() < 8 {
+		return q, ErrInvalidICMPHeader
+	}
+
+	q.setSegment(netip.AddrFrom16(source), netip.AddrFrom16(destination), data[len(data)-reader.Len():])
+	return q, nil
+}
+
+// handleICMPv6 processes an ICMPv6 message addressed to the stack.
+func handleICMPv6(ip *IPv6, message []byte, connections *Connections) {
+	if !verifyICMPv6Checksum(ip.SourceAddress, ip.DestinationAddress, message) {
+		drops.Add(parseLog, "bad ICMPv6 checksum", "src", ip.SourceAddress)
+		return
+	}
+
+	reader := bytes.NewReader(message)
+	icmp, err := parseICMPHeader(reader)
+	if err != nil {
+		drops.Add(parseLog, ErrInvalidICMPHeader.Error(), "src", ip.SourceAddress)
+		return
+	}
+
+	rest := message[len(message)-reader.Len():]
+
+	switch icmp.Type {
+	case ICMPV6_ECHO_REQUEST:
+		connections.ping.Echo(ip.SourceAddress, ip.DestinationAddress, &icmp, rest)
+
+	case ICMPV6_ECHO_REPLY:
+		connections.ping.Reply(ip.SourceAddress, ip.HopLimit, &icmp, rest)
+
+	case ICMPV6_PACKET_TOO_BIG:
+		q, err := parseQuotedIPv6Segment(rest)
+		if err != nil {
+			drops.Add(parseLog, err.Error(), "src", ip.SourceAddress, "type", icmp.Type)
+			return
+		}
+
+		// RFC 8201 §4: never go below the minimum link MTU
+		mtu := icmp.Rest
+		if mtu < IPV6_MIN_MTU {
+			mtu = IPV6_MIN_MTU
+		}
+		if mtu > IP_MAX_DATAGRAM_LENGTH {
+			mtu = IP_MAX_DATAGRAM_LENGTH
+		}
+
+		connections.FragmentationNeeded(q, uint16(mtu))
+
+	case ICMPV6_DESTINATION_UNREACHABLE, ICMPV6_TIME_EXCEEDED:
+		q, err := parseQuotedIPv6Segment(rest)
+		if err != nil {
+			drops.Add(parseLog, err.Error(), "src", ip.SourceAddress, "type", icmp.Type)
+			return
+		}
+
+		connections.ICMPError(q, icmp.ErrorIPv6())
+
+	case ICMPV6_NEIGHBOR_SOLICITATION:
+		connections.neighbors.Solicitation(ip, &icmp, rest)
+	}
+}
+
+// NeighborDiscovery answers Neighbor Solicitations for the stack's IPv6
+// address (RFC 4861), the IPv6 equivalent of answering ARP requests. It only
+// applies to links with link-layer addresses; on a TUN device LinkAddress is
+// nil and solicitations are ignored.
+// solicitedNodeAddress returns the multicast group that neighbor solicitations
+// for addr are sent to (RFC 4291 §2.7.1), or the zero Addr if addr isn't an
+// IPv6 address.
+func solicitedNodeAddress(addr netip.Addr) netip.Addr {
+	if !addr.Is6() {
+		return netip.Addr{}
+	}
+
+	b := addr.As16()
+	return netip.AddrFrom16([16]byte{0xFF, 0x02, 11: 0x01, 12: 0xFF, 13: b[13], 14: b[14], 15: b[15]})
+}
+
+type NeighborDiscovery struct {
+	out         *IPOutput
+	LocalIP     netip.Addr
+	LinkAddress net.HardwareAddr
+}
+
+func NewNeighborDiscovery(out *IPOutput, localIP netip.Addr, linkAddress net.HardwareAddr) *NeighborDiscovery {
+	return &NeighborDiscovery{out: out, LocalIP: localIP, LinkAddress: linkAddress}
+}
+
+// Solicitation answers a Neighbor Solicitation for our address with a
+// Neighbor Advertisement carrying our link-layer address.
+func (n *NeighborDiscovery) Solicitation(ip *IPv6, solicitation *ICMP, body []byte) {
+	/*
+	    0                   1                   2                   3
+	    0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1
+	   +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+	   |     Type      |     Code      |          Checksum             |
+	   +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+	   |                           Reserved                            |
+	   +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+	   |                                                               |
+	   +                       Target Address                          +
+	   |                                                               |
+	   +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+	   |   Options ...
+	   +-+-+-+-+-+-+-+-+-+-+-+-+-
+	**/
+
+	if ip.HopLimit != ND_HOP_LIMIT || solicitation.Code != 0 || len(body) < 16 {
+		drops.Add(parseLog, "invalid neighbor solicitation", "src", ip.SourceAddress)
+		return
+	}
+
+	var target [16]byte
+	copy(target[:], body[:16])
+	if netip.AddrFrom16(target) != n.LocalIP {
+		return
+	}
+
+	if n.LinkAddress == nil {
+		drops.Add(linkLog, "neighbor solicitation on a link without addresses", "src", ip.SourceAddress)
+		return
+	}
+
+	// A solicitation from the unspecified address is duplicate address
+	// detection; the answer goes to all nodes and isn't marked solicited
+	destination := ip.SourceAddress
+	advertisement := ICMP{Type: ICMPV6_NEIGHBOR_ADVERTISEMENT, Rest: ND_FLAG_SOLICITED | ND_FLAG_OVERRIDE}
+	if destination.IsUnspecified() {
+		destination = netip.IPv6LinkLocalAllNodes()
+		advertisement.Rest = ND_FLAG_OVERRIDE
+	}
+
+	payload := append([]byte{}, target[:]...)
+	payload = append(payload, ND_OPTION_TARGET_LINK_ADDRESS, uint8((2+len(n.LinkAddress)+7)/8))
+	payload = append(payload, n.LinkAddress...)
+	for len(payload)%8 != 0 {
+		payload = append(payload, 0)
+	}
+
+	err := sendICMP(n.out, n.LocalIP, destination, ND_HOP_LIMIT, advertisement, payload)
+	if err != nil {
+		linkLog.Error("failed to send neighbor advertisement", "dst", destination, "err", err)
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/netip"
+)
+
+const (
+	IPV6_HEADER_LENGTH = 40
+
+	// Next header values for the extension headers we know how to skip
+	IPV6_HOP_BY_HOP_OPTIONS = 0
+	IPV6_ROUTING            = 43
+	IPV6_FRAGMENT           = 44
+	IPV6_DESTINATION_OPTS   = 60
+	IPV6_NO_NEXT_HEADER     = 59
+
+	// RFC 8200 §5: every link must carry 1280 byte packets
+	IPV6_MIN_MTU = 1280
+)
+
+var ErrInvalidIPv6Header = fmt.Errorf("failed to parse IPv6 header")
+var ErrIPv6Fragment = fmt.Errorf("can't reassemble IPv6 fragments")
+var ErrIPv6NoNextHeader = fmt.Errorf("IPv6 packet with no upper-layer header")
+
+type IPv6 struct {
+	Version, TrafficClass, HopLimit uint8
+	FlowLabel                       uint32
+	PayloadLength                   uint16
+
+	// NextHeader is the header following the fixed header. Protocol is the
+	// upper-layer protocol, after any extension headers.
+	NextHeader, Protocol uint8
+
+	SourceAddress, DestinationAddress netip.Addr
+}
+
+// parseIPv6Header parses the fixed header and skips any extension headers,
+// leaving buf at the start of the upper-layer header.
+func parseIPv6Header(buf *bytes.Reader) (ip IPv6, err error) {
+	/*
+	    0                   1                   2                   3
+	    0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1
+	   +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+	   |Version| Traffic Class |           Flow Label                  |
+	   +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+	   |         Payload Length        |  Next Header  |   Hop Limit   |
+	   +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+	   |                                                               |
+	   +                                                               +
+	   |                         Source Address                        |
+	   +                                                               +
+	   |                                                               |
+	   +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+	   |                                                               |
+	   +                                                               +
+	   |                      Destination Address                      |
+	   +                                                               +
+	   |                                                               |
+	   +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+	**/
+
+	if buf.Len() < IPV6_HEADER_LENGTH {
+		return ip, ErrInvalidIPv6Header
+	}
+
+	var temp uint32
+	err = binary.Read(buf, binary.BigEndian, &temp)
+	if err != nil {
+		return
+	}
+
+	ip.Version = uint8(temp >> 28)
+	ip.TrafficClass = uint8(temp >> 20)
+	ip.FlowLabel = temp & 0xFFFFF
+
+	if ip.Version != 6 {
+		return ip, ErrInvalidIPv6Header
+	}
+
+	err = binary.Read(buf, binary.BigEndian, &ip.PayloadLength)
+	if err != nil {
+		return
+	}
+
+	// As with IPv4, anything past the payload is link-layer padding
+	if int64(IPV6_HEADER_LENGTH)+int64(ip.PayloadLength) > buf.Size() {
+		return ip, ErrIPTruncated
+	}
+
+	ip.NextHeader, err = buf.ReadByte()
+	if err != nil {
+		return
+	}
+
+	ip.HopLimit, err = buf.ReadByte()
+	if err != nil {
+		return
+	}
+
+	var addr [16]byte
+	_, err = io.ReadFull(buf, addr[:])
+	if err != nil {
+		return
+	}
+	ip.SourceAddress = netip.AddrFrom16(addr)
+
+	_, err = io.ReadFull(buf, addr[:])
+	if err != nil {
+		return
+	}
+	ip.DestinationAddress = netip.AddrFrom16(addr)
+
+	ip.Protocol, err = skipExtensionHeaders(buf, ip.NextHeader)
+	return
+}
+
+// skipExtensionHeaders walks the chain of extension headers starting with
+// next, returning the upper-layer protocol (RFC 8200 §4).
+func skipExtensionHeaders(buf *bytes.Reader, next uint8) (uint8, error) {
+	for {
+		switch next {
+		case IPV6_HOP_BY_HOP_OPTIONS, IPV6_ROUTING, IPV6_DESTINATION_OPTS:
+			// Next header, then the length in 8-octet units not including
+			// the first 8 octets
+			header := make([]byte, 2)
+			if _, err := io.ReadFull(buf, header); err != nil {
+				return next, ErrInvalidIPv6Header
+			}
+
+			length := int(header[1])*8 + 6
+			if buf.Len() < length {
+				return next, ErrInvalidIPv6Header
+			}
+			buf.Seek(int64(length), io.SeekCurrent)
+
+			next = header[0]
+
+		case IPV6_FRAGMENT:
+			return next, ErrIPv6Fragment
+
+		case IPV6_NO_NEXT_HEADER:
+			return next, ErrIPv6NoNextHeader
+
+		default:
+			return next, nil
+		}
+	}
+}
+
+func (ip *IPv6) Serialize() *bytes.Buffer {
+	buf := bytes.NewBuffer([]byte{})
+
+	var temp uint32
+	temp |= uint32(ip.Version) << 28
+	temp |= uint32(ip.TrafficClass) << 20
+	temp |= ip.FlowLabel & 0xFFFFF
+
+	binary.Write(buf, binary.BigEndian, temp)
+	binary.Write(buf, binary.BigEndian, ip.PayloadLength)
+	buf.WriteByte(ip.NextHeader)
+	buf.WriteByte(ip.HopLimit)
+
+	source := ip.SourceAddress.As16()
+	destination := ip.DestinationAddress.As16()
+	buf.Write(source[:])
+	buf.Write(destination[:])
+
+	return buf
+}
+
+func (ip *IPv6) Inspect() {
+	fmt.Printf("----- IPv6 Header -----\n")
+	fmt.Printf("IP version:      %d\n", ip.Version)
+	fmt.Printf("Traffic class:   %d\n", ip.TrafficClass)
+	fmt.Printf("Flow label:      %d\n", ip.FlowLabel)
+	fmt.Printf("Payload length:  %d\n", ip.PayloadLength)
+	fmt.Printf("Next header:     %d\n", ip.NextHeader)
+	fmt.Printf("Hop limit:       %d\n", ip.HopLimit)
+	fmt.Printf("Protocol:        %d\n", ip.Protocol)
+	fmt.Printf("Source IP:       %s\n", ip.SourceAddress)
+	fmt.Printf("Dest IP:         %s\n", ip.DestinationAddress)
+}
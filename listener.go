@@ -0,0 +1,48 @@
+package main
+
+import "fmt"
+
+const (
+	DEFAULT_SYN_BACKLOG    = 128
+	DEFAULT_ACCEPT_BACKLOG = 128
+)
+
+// Listener tracks the connections on a local port that haven't been handed to
+// the application yet. The SYN queue holds connections in SYN-RECEIVED; once
+// it's full, new SYNs are answered with SYN cookies. The accept queue holds
+// established connections that haven't been accepted; once it's full, the
+// final ACK of a handshake is dropped. Listeners are keyed by port alone, so
+// they accept connections over both IPv4 and IPv6.
+type Listener struct {
+	Port                      uint16
+	SynBacklog, AcceptBacklog int
+
+	// Set for ports that haven't been configured with Listen: connections are
+	// accepted as soon as they're established, so the accept queue stays empty
+	AutoAccept bool
+
+	synQueue, acceptQueue []Quad
+}
+
+func (l *Listener) remove(quad Quad) {
+	l.synQueue = removeQuad(l.synQueue, quad)
+	l.acceptQueue = removeQuad(l.acceptQueue, quad)
+}
+
+func (l *Listener) Inspect() {
+	fmt.Printf("port %d: syn queue %d/%d, accept queue %d/%d",
+		l.Port, len(l.synQueue), l.SynBacklog, len(l.acceptQueue), l.AcceptBacklog)
+	if l.AutoAccept {
+		fmt.Printf(" (auto-accept)")
+	}
+	fmt.Println()
+}
+
+func removeQuad(quads []Quad, quad Quad) []Quad {
+	for i, q := range quads {
+		if q == quad {
+			return append(quads[:i:i], quads[i+1:]...)
+		}
+	}
+	return quads
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/netip"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Subsystems whose log levels can be set separately
+const (
+	LOG_PARSE = "parse"
+	LOG_TCP   = "tcp"
+	LOG_REPL  = "repl"
+	LOG_LINK  = "link"
+)
+
+var logLevels = map[string]*slog.LevelVar{
+	LOG_PARSE: new(slog.LevelVar),
+	LOG_TCP:   new(slog.LevelVar),
+	LOG_REPL:  new(slog.LevelVar),
+	LOG_LINK:  new(slog.LevelVar),
+}
+
+// One logger per subsystem. These log text to stderr until setupLogging is
+// called.
+var (
+	parseLog = newSubsystemLogger(LOG_PARSE, false)
+	tcpLog   = newSubsystemLogger(LOG_TCP, false)
+	replLog  = newSubsystemLogger(LOG_REPL, false)
+	linkLog  = newSubsystemLogger(LOG_LINK, false)
+)
+
+func newSubsystemLogger(subsystem string, json bool) *slog.Logger {
+	options := &slog.HandlerOptions{Level: logLevels[subsystem]}
+
+	var handler slog.Handler = slog.NewTextHandler(os.Stderr, options)
+	if json {
+		handler = slog.NewJSONHandler(os.Stderr, options)
+	}
+
+	return slog.New(handler).With("subsystem", subsystem)
+}
+
+// setupLogging sets the output format and the initial levels. levels is
+// either a single level for every subsystem, or a comma-separated list like
+// "tcp=debug,parse=warn".
+func setupLogging(json bool, levels string) error {
+	parseLog = newSubsystemLogger(LOG_PARSE, json)
+	tcpLog = newSubsystemLogger(LOG_TCP, json)
+	replLog = newSubsystemLogger(LOG_REPL, json)
+	linkLog = newSubsystemLogger(LOG_LINK, json)
+
+	if levels == "" {
+		return nil
+	}
+
+	for _, setting := range strings.Split(levels, ",") {
+		subsystem, level, ok := strings.Cut(setting, "=")
+		if !ok {
+			subsystem, level = "", setting
+		}
+
+		err := SetLogLevel(subsystem, level)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// SetLogLevel changes a subsystem's level, or every subsystem's if subsystem
+// is empty.
+func SetLogLevel(subsystem, level string) error {
+	var l slog.Level
+	err := l.UnmarshalText([]byte(level))
+	if err != nil {
+		return fmt.Errorf("invalid log level %q", level)
+	}
+
+	if subsystem == "" {
+		for _, v := range logLevels {
+			v.Set(l)
+		}
+		return nil
+	}
+
+	v, ok := logLevels[subsystem]
+	if !ok {
+		return fmt.Errorf("unknown log subsystem %q", subsystem)
+	}
+
+	v.Set(l)
+	return nil
+}
+
+func InspectLogLevels() {
+	subsystems := make([]string, 0, len(logLevels))
+	for subsystem := range logLevels {
+		subsystems = append(subsystems, subsystem)
+	}
+	sort.Strings(subsystems)
+
+	for _, subsystem := range subsystems {
+		fmt.Printf("%-6s %s\n", subsystem+":", logLevels[subsystem].Level())
+	}
+}
+
+// LogValue logs a quad as the remote and local ends, rather than as a struct.
+func (q Quad) LogValue() slog.Value {
+	return slog.GroupValue(
+		slog.String("remote", netip.AddrPortFrom(q.SourceIP, q.SourcePort).String()),
+		slog.String("local", netip.AddrPortFrom(q.DestinationIP, q.DestinationPort).String()),
+	)
+}
+
+// logger tags records with the connection's ID, quad and current state. The
+// caller holds c.mu.
+func (c *Connection) logger() *slog.Logger {
+	return tcpLog.With("conn", c.ID, "quad", c.Quad, "state", c.State.String())
+}
+
+// Logger is logger for callers that don't hold c.mu.
+func (c *Connection) Logger() *slog.Logger {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.logger()
+}
+
+// fatal logs an error the stack can't carry on after, and exits.
+func fatal(logger *slog.Logger, msg string, args ...any) {
+	logger.Error(msg, args...)
+	os.Exit(1)
+}
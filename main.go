@@ -2,116 +2,284 @@ package main
 
 import (
 	"bytes"
-	"fmt"
-	"log"
-	"math/rand"
+	"flag"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"strings"
 	"time"
 
 	"github.com/songgao/water"
 )
 
+// Quad identifies a connection from the peer's point of view: the source is
+// the remote end. The addresses are either both IPv4 or both IPv6.
 type Quad struct {
-	SourceIP, DestinationIP     uint32
+	SourceIP, DestinationIP     netip.Addr
 	SourcePort, DestinationPort uint16
 }
 
-type Connections struct {
-	m   map[Quad]*Connection
-	ids []Quad
-}
+func main() {
+	if len(os.Args) > 1 && os.Args[1] == "analyze" {
+		analyzeCommand(os.Args[2:])
+		return
+	}
+
+	seed := flag.Int64("seed", 0, "use a deterministic ISN generator with this seed (for testing)")
+	synBacklog := flag.Int("syn-backlog", DEFAULT_SYN_BACKLOG, "default per-listener SYN queue size")
+	acceptBacklog := flag.Int("accept-backlog", DEFAULT_ACCEPT_BACKLOG, "default per-listener accept queue size")
+	mtu := flag.Int("mtu", DEFAULT_MTU, "link MTU; larger datagrams are fragmented unless DF is set")
+	plpmtud := flag.Bool("plpmtud", true, "probe for the path MTU instead of relying on ICMP (RFC 4821)")
+	addr := flag.String("addr", "10.0.0.2/24", "the stack's own IPv4 address and subnet, used as the source of pings")
+	addr6 := flag.String("addr6", "fd00::2", "the stack's own IPv6 address, used for pings and neighbor discovery; empty to disable IPv6")
+	tap := flag.Bool("tap", false, "use a TAP device with Ethernet framing and ARP instead of a TUN device")
+	mac := flag.String("mac", "02:00:00:00:00:02", "the stack's Ethernet address in TAP mode")
+	capturePath := flag.String("capture", "", "write all packets to this pcap file")
+	captureFilter := flag.String("capture-filter", "", `only capture matching packets, e.g. "port 80" or "quad 10.0.0.1:5000 10.0.0.2:80"`)
+	captureMaxBytes := flag.Int64("capture-max-bytes", 0, "start a new capture file once the current one reaches this size (0 for no limit)")
+	noVerifyChecksums := flag.Bool("no-verify-checksums", false, "accept packets with bad checksums (for links with checksum offload)")
+	logLevel := flag.String("log-level", "info", `log level for every subsystem, or per subsystem, e.g. "tcp=debug,parse=warn"`)
+	logJSON := flag.Bool("log-json", false, "log in JSON rather than text")
+	flag.Parse()
+
+	err := setupLogging(*logJSON, *logLevel)
+	if err != nil {
+		fatal(replLog, "invalid -log-level", "err", err)
+	}
 
-func (c *Connections) Inspect() {
-	fmt.Printf("%d connections:\n", len(c.m))
-	for i, quad := range c.ids {
-		if _, ok := c.m[quad]; ok {
-			fmt.Printf("%d: %+v %v\n", i, quad, c.m[quad])
+	var isn *ISNGenerator
+	if *seed != 0 {
+		isn = NewSeededISNGenerator(*seed)
+	} else {
+		isn, err = NewISNGenerator()
+		if err != nil {
+			fatal(tcpLog, "failed to create ISN generator", "err", err)
 		}
 	}
-}
 
-func main() {
-	rand.Seed(time.Now().UnixMilli())
+	cookies, err := NewSynCookies()
+	if err != nil {
+		fatal(tcpLog, "failed to create SYN cookie secret", "err", err)
+	}
+
+	// A bare address is a subnet of its own
+	if !strings.Contains(*addr, "/") {
+		*addr += "/32"
+	}
+	subnet, err := netip.ParsePrefix(*addr)
+	if err != nil || !subnet.Addr().Is4() {
+		fatal(replLog, "invalid IPv4 address", "addr", *addr)
+	}
+	localIP := subnet.Addr()
+
+	var localIPv6 netip.Addr
+	if *addr6 != "" {
+		localIPv6, err = netip.ParseAddr(*addr6)
+		if err != nil || !localIPv6.Is6() {
+			fatal(replLog, "invalid IPv6 address", "addr", *addr6)
+		}
+	}
+
+	// The MTU can't be smaller than the minimum every host must accept, which
+	// is larger for IPv6, or larger than the largest possible datagram
+	minMTU := IP_MIN_DATAGRAM_LENGTH
+	if localIPv6.IsValid() {
+		minMTU = IPV6_MIN_MTU
+	}
+	if *mtu < minMTU || *mtu > IP_MAX_DATAGRAM_LENGTH {
+		fatal(replLog, "invalid -mtu", "mtu", *mtu, "min", minMTU, "max", IP_MAX_DATAGRAM_LENGTH)
+	}
 
 	config := water.Config{DeviceType: water.TUN}
 	config.Name = "tun_tcp"
+	if *tap {
+		config = water.Config{DeviceType: water.TAP}
+		config.Name = "tap_tcp"
+	}
 
 	ifce, err := water.New(config)
 	if err != nil {
-		log.Fatal(err)
+		fatal(linkLog, "failed to open device", "name", config.Name, "err", err)
+	}
+
+	// In TAP mode the link deals with Ethernet and ARP, so everything above it
+	// sees IP packets just as it would on a TUN device
+	var dev io.ReadWriter = ifce
+	var link *EthernetLink
+	var linkAddress net.HardwareAddr
+	if *tap {
+		linkAddress, err = net.ParseMAC(*mac)
+		if err != nil {
+			fatal(replLog, "invalid MAC address", "mac", *mac, "err", err)
+		}
+
+		link = NewEthernetLink(ifce, linkAddress, addrToUint32(localIP), *mtu)
+		dev = link
+		go link.timers()
+	}
+
+	capture := NewCaptureLink(dev, *captureMaxBytes)
+	dev = capture
+	if *capturePath != "" {
+		filter, err := parseCaptureFilter(strings.Fields(*captureFilter))
+		if err != nil {
+			fatal(replLog, "invalid -capture-filter", "err", err)
+		}
+
+		err = capture.Start(*capturePath, filter)
+		if err != nil {
+			fatal(linkLog, "failed to start capture", "path", *capturePath, "err", err)
+		}
 	}
 
-	buf := make([]byte, 1500)
-	connections := Connections{m: make(map[Quad]*Connection)}
+	buf := make([]byte, *mtu)
+	out := NewIPOutput(dev, *mtu)
+
+	ping := NewPinger(out, localIP, localIPv6)
+	neighbors := NewNeighborDiscovery(out, localIPv6, linkAddress)
+	udp := NewUDPEndpoints(out, subnet, localIPv6)
+	connections := NewConnections(isn, cookies, out, ping, neighbors, udp, *synBacklog, *acceptBacklog)
+	connections.PLPMTUD = *plpmtud
+	connections.Link = link
+	connections.Capture = capture
+	reassembler := NewReassembler(REASSEMBLY_MAX_MEMORY, REASSEMBLY_TIMEOUT)
 
-	go repl(ifce, &connections)
+	go repl(connections)
+	go timers(connections)
 
 	for {
-		n, err := ifce.Read(buf)
+		n, err := dev.Read(buf)
 		if err != nil {
-			log.Fatal(err)
+			fatal(linkLog, "failed to read from device", "err", err)
 		}
 
-		reader := bytes.NewReader(buf[:n])
+		packet := buf[:n]
 
-		ip, err := parseIPHeader(reader)
+		ip, err := parseIPHeader(bytes.NewReader(packet))
+		if err == ErrNonIPv4 && !localIPv6.IsValid() {
+			drops.Add(parseLog, ErrIPv6Disabled.Error())
+			continue
+		}
 		if err == ErrNonIPv4 {
+			handleIPv6(packet, connections, !*noVerifyChecksums)
 			continue
 		}
 		if err != nil {
-			log.Fatal(err)
+			drops.Add(parseLog, err.Error())
+			continue
 		}
 
-		if ip.Protocol != 0x06 {
-			// Not TCP
+		// parseIPHeader has checked these bounds; anything past TotalLength is
+		// padding and mustn't be treated as payload
+		headerLength := int(ip.HeaderLength) * 4
+		packet = packet[:ip.TotalLength]
+
+		if !*noVerifyChecksums && !verifyIPChecksum(packet[:headerLength]) {
+			drops.Add(parseLog, "bad IP checksum", "src", addrFromUint32(ip.SourceAddress), "dst", addrFromUint32(ip.DestinationAddress))
 			continue
 		}
 
-		tcp, err := parseTCPHeader(reader)
-		if err != nil {
-			log.Fatal(err)
-		}
+		segment := packet[headerLength:]
 
-		quad := Quad{
-			SourceIP: ip.SourceAddress, DestinationIP: ip.DestinationAddress,
-			SourcePort: tcp.SourcePort, DestinationPort: tcp.DestinationPort,
+		if ip.IsFragment() {
+			var complete bool
+			ip, segment, complete, err = reassembler.Add(ip, segment, time.Now())
+			if err != nil {
+				drops.Add(parseLog, err.Error(), "src", addrFromUint32(ip.SourceAddress), "dst", addrFromUint32(ip.DestinationAddress), "id", ip.Identification)
+				continue
+			}
+			if !complete {
+				continue
+			}
 		}
 
-		if _, ok := connections.m[quad]; !ok {
-			c := Connection{}
-			c.Initialize(&tcp)
-			connections.m[quad] = &c
-			connections.ids = append(connections.ids, quad)
+		if ip.Protocol == 0x01 {
+			handleICMP(&ip, segment, connections)
+			continue
 		}
 
-		c := connections.m[quad]
-		respTcp, err := c.HandleSegment(&tcp, reader)
-		if err != nil {
-			// Error handling segment, remove connection
-			delete(connections.m, quad)
+		if ip.Protocol == 17 {
+			quote := append(ip.Serialize().Bytes(), segment...)
+			handleUDP(addrFromUint32(ip.SourceAddress), addrFromUint32(ip.DestinationAddress), segment, quote, connections, !*noVerifyChecksums)
 			continue
 		}
 
-		if respTcp == (TCP{}) {
+		if ip.Protocol != 0x06 {
+			drops.Add(parseLog, "unsupported protocol", "protocol", ip.Protocol)
 			continue
 		}
 
-		respIp := IP{
-			Version:            4,
-			HeaderLength:       5,
-			TotalLength:        10 * 4,
-			TimeToLive:         64,
-			Flags:              2,
-			Protocol:           6,
-			SourceAddress:      ip.DestinationAddress,
-			DestinationAddress: ip.SourceAddress,
-		}
+		handleTCP(addrFromUint32(ip.SourceAddress), addrFromUint32(ip.DestinationAddress), segment, connections, !*noVerifyChecksums)
+	}
+}
 
-		response := respIp.Serialize()
-		response.Write(respTcp.Serialize(&respIp, []byte{}).Bytes())
+func handleIPv6(packet []byte, connections *Connections, verifyChecksums bool) {
+	reader := bytes.NewReader(packet)
+	ip, err := parseIPv6Header(reader)
+	if err != nil {
+		drops.Add(parseLog, err.Error())
+		return
+	}
 
-		_, err = response.WriteTo(ifce)
-		if err != nil {
-			log.Fatal(err)
-		}
+	// Anything past the payload is padding; the extension headers must fit
+	// inside it
+	end := IPV6_HEADER_LENGTH + int(ip.PayloadLength)
+	start := len(packet) - reader.Len()
+	if start > end {
+		drops.Add(parseLog, ErrInvalidIPv6Header.Error(), "src", ip.SourceAddress, "dst", ip.DestinationAddress)
+		return
+	}
+
+	if ip.Protocol == IPV6_NEXT_HEADER_ICMPV6 {
+		handleICMPv6(&ip, packet[start:end], connections)
+		return
+	}
+
+	if ip.Protocol == 17 {
+		handleUDP(ip.SourceAddress, ip.DestinationAddress, packet[start:end], packet[:end], connections, verifyChecksums)
+		return
+	}
+
+	if ip.Protocol != 0x06 {
+		drops.Add(parseLog, "unsupported protocol", "protocol", ip.Protocol)
+		return
+	}
+
+	handleTCP(ip.SourceAddress, ip.DestinationAddress, packet[start:end], connections, verifyChecksums)
+}
+
+// handleTCP passes a segment from either address family to its connection and
+// sends any response.
+func handleTCP(source, destination netip.Addr, segment []byte, connections *Connections, verifyChecksums bool) {
+	if verifyChecksums && !verifyTCPChecksum(source, destination, segment) {
+		drops.Add(parseLog, "bad TCP checksum", "src", source, "dst", destination)
+		return
+	}
+
+	reader := bytes.NewReader(segment)
+	tcp, err := parseTCPHeader(reader)
+	if err != nil {
+		drops.Add(parseLog, "malformed TCP header", "src", source, "dst", destination, "err", err)
+		return
+	}
+
+	quad := Quad{
+		SourceIP: source, DestinationIP: destination,
+		SourcePort: tcp.SourcePort, DestinationPort: tcp.DestinationPort,
+	}
+
+	respTcp, err := connections.Handle(quad, &tcp, reader)
+	if err != nil {
+		// Handle has already removed the connection and logged why
+		return
+	}
+	if respTcp == (TCP{}) {
+		return
+	}
+
+	err = connections.Send(quad, respTcp, []byte{})
+	if err != nil {
+		tcpLog.Error("failed to send response", "quad", quad, "err", err)
 	}
 }
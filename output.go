@@ -0,0 +1,202 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+const (
+	// TIMER_GRANULARITY is how often connection timers are checked.
+	TIMER_GRANULARITY = 100 * time.Millisecond
+
+	DEFAULT_MTU = 1500
+	DEFAULT_TTL = 64
+
+	// RFC 791: every host must accept datagrams of this size, so no link's
+	// MTU can be smaller
+	IP_MIN_DATAGRAM_LENGTH = 576
+)
+
+var ErrMessageTooLong = fmt.Errorf("datagram is larger than the MTU and DF is set")
+var ErrIPv6Disabled = fmt.Errorf("IPv6 is disabled")
+
+// IPOutput builds IPv4 datagrams and writes them to the link, fragmenting
+// them if they don't fit in the MTU.
+type IPOutput struct {
+	mu sync.Mutex
+
+	w   io.Writer
+	MTU int
+
+	// RFC 6864 only requires Identification to be unique per (source,
+	// destination, protocol) for as long as fragments may be in flight. One
+	// counter for everything, starting at a random value, is unique for all
+	// of them at once.
+	id uint16
+}
+
+func NewIPOutput(w io.Writer, mtu int) *IPOutput {
+	return &IPOutput{
+		w:   w,
+		MTU: mtu,
+		id:  uint16(rand.Uint32()),
+	}
+}
+
+func (o *IPOutput) nextIdentification() uint16 {
+	o.id++
+	return o.id
+}
+
+// Send writes payload in a datagram using the addresses, protocol, TTL, DF
+// flag and options from ip. The remaining header fields are filled in here.
+func (o *IPOutput) Send(ip IP, payload []byte) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	ip.Version = 4
+	ip.Flags &^= 0x01
+	ip.FragmentOffset = 0
+	ip.Identification = o.nextIdentification()
+
+	headerLength := IP_MIN_HEADER_LENGTH*4 + len(ip.serializeOptions())
+	if headerLength+len(payload) <= o.MTU {
+		ip.TotalLength = uint16(headerLength + len(payload))
+		return o.write(&ip, payload)
+	}
+
+	if ip.Flags&0x02 == 0x02 {
+		return ErrMessageTooLong
+	}
+
+	for offset := 0; offset < len(payload); {
+		fragment := ip
+
+		// Only options with the copied flag set go in every fragment (RFC 791)
+		if offset > 0 {
+			fragment.Options = nil
+			for _, option := range ip.Options {
+				if option.Type&0x80 == 0x80 {
+					fragment.Options = append(fragment.Options, option)
+				}
+			}
+		}
+
+		headerLength := IP_MIN_HEADER_LENGTH*4 + len(fragment.serializeOptions())
+
+		// Fragment payloads are measured in 8-byte units
+		size := (o.MTU - headerLength) &^ 7
+		if size <= 0 {
+			return ErrMessageTooLong
+		}
+		if offset+size >= len(payload) {
+			size = len(payload) - offset
+		} else {
+			fragment.Flags |= 0x01 // MF
+		}
+
+		fragment.FragmentOffset = uint16(offset / 8)
+		fragment.TotalLength = uint16(headerLength + size)
+
+		err := o.write(&fragment, payload[offset:offset+size])
+		if err != nil {
+			return err
+		}
+
+		offset += size
+	}
+
+	return nil
+}
+
+func (o *IPOutput) write(ip *IP, payload []byte) error {
+	packet := ip.Serialize()
+	packet.Write(payload)
+
+	_, err := packet.WriteTo(o.w)
+	return err
+}
+
+// SendIPv6 writes payload in a packet using the addresses, next header and hop
+// limit from ip. IPv6 routers never fragment, and we don't fragment at the
+// source, so the packet has to fit in the MTU.
+func (o *IPOutput) SendIPv6(ip IPv6, payload []byte) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if !ip.SourceAddress.IsValid() {
+		// We have no IPv6 address to send from
+		return ErrIPv6Disabled
+	}
+
+	if IPV6_HEADER_LENGTH+len(payload) > o.MTU {
+		return ErrMessageTooLong
+	}
+
+	ip.Version = 6
+	ip.PayloadLength = uint16(len(payload))
+
+	packet := ip.Serialize()
+	packet.Write(payload)
+
+	_, err := packet.WriteTo(o.w)
+	return err
+}
+
+// Send wraps a TCP segment in an IP header addressed back to the peer in quad
+// and writes it to the link, using the connection's DF setting.
+func (c *Connections) Send(quad Quad, tcp TCP, payload []byte) error {
+	dontFragment := true
+
+	c.mu.Lock()
+	conn, ok := c.m[quad]
+	if ok {
+		dontFragment = conn.GetDontFragment()
+
+		before, after, trace := conn.traceOutgoing()
+		if c.Trace || trace {
+			traceSegment(time.Now(), false, quad, &tcp, len(payload), conn, before, after)
+		}
+	} else if c.Trace {
+		traceSegment(time.Now(), false, quad, &tcp, len(payload), nil, CLOSED, CLOSED)
+	}
+	c.mu.Unlock()
+
+	segment := tcp.Serialize(quad.DestinationIP, quad.SourceIP, payload).Bytes()
+
+	if quad.SourceIP.Is6() {
+		return c.out.SendIPv6(IPv6{
+			HopLimit:           DEFAULT_TTL,
+			NextHeader:         6,
+			SourceAddress:      quad.DestinationIP,
+			DestinationAddress: quad.SourceIP,
+		}, segment)
+	}
+
+	ip := IP{
+		TimeToLive:         DEFAULT_TTL,
+		Protocol:           6,
+		SourceAddress:      addrToUint32(quad.DestinationIP),
+		DestinationAddress: addrToUint32(quad.SourceIP),
+	}
+
+	if dontFragment {
+		ip.Flags |= 0x02 // DF
+	}
+
+	return c.out.Send(ip, segment)
+}
+
+func timers(connections *Connections) {
+	for now := range time.Tick(TIMER_GRANULARITY) {
+		for _, segment := range connections.Tick(now) {
+			err := connections.Send(segment.Quad, segment.TCP, segment.Payload)
+			if err != nil {
+				tcpLog.Error("failed to retransmit", "quad", segment.Quad, "err", err)
+			}
+		}
+	}
+}
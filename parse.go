@@ -5,10 +5,28 @@ import (
 	"encoding/binary"
 	"fmt"
 	"io"
+	"net/netip"
 )
 
 var ErrInvalidIPHeader = fmt.Errorf("failed to parse IP header")
+var ErrIPTruncated = fmt.Errorf("IP packet shorter than its total length")
+var ErrTTLExpired = fmt.Errorf("IP packet with zero TTL")
 var ErrNonIPv4 = fmt.Errorf("can't handle non-IPv4 packets")
+var ErrInvalidTCPHeader = fmt.Errorf("failed to parse TCP header")
+
+// verifyIPChecksum checks the checksum of a raw IPv4 header, including options.
+func verifyIPChecksum(header []byte) bool {
+	return add1sComplementBytes(0, header) == 0xFFFF
+}
+
+// verifyTCPChecksum checks the checksum of a raw TCP segment (header, options
+// and payload) against the pseudo-header for the given addresses.
+func verifyTCPChecksum(source, destination netip.Addr, segment []byte) bool {
+	sum := pseudoHeaderSum(source, destination, 6, len(segment))
+	sum = add1sComplementBytes(sum, segment)
+
+	return sum == 0xFFFF
+}
 
 func parseIPHeader(buf *bytes.Reader) (ip IP, err error) {
 	/*
@@ -29,6 +47,10 @@ func parseIPHeader(buf *bytes.Reader) (ip IP, err error) {
 	   +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
 	**/
 
+	if buf.Len() < IP_MIN_HEADER_LENGTH*4 {
+		return ip, ErrInvalidIPHeader
+	}
+
 	ip.Version, err = buf.ReadByte()
 	if err != nil {
 		return
@@ -41,6 +63,10 @@ func parseIPHeader(buf *bytes.Reader) (ip IP, err error) {
 		return ip, ErrNonIPv4
 	}
 
+	if ip.HeaderLength < IP_MIN_HEADER_LENGTH {
+		return ip, ErrInvalidIPHeader
+	}
+
 	ip.TypeOfService, err = buf.ReadByte()
 	if err != nil {
 		return
@@ -51,6 +77,16 @@ func parseIPHeader(buf *bytes.Reader) (ip IP, err error) {
 		return
 	}
 
+	if int(ip.TotalLength) < int(ip.HeaderLength)*4 {
+		return ip, ErrInvalidIPHeader
+	}
+
+	// Anything past TotalLength is link-layer padding, but the packet can't be
+	// shorter than it claims
+	if int64(ip.TotalLength) > buf.Size() {
+		return ip, ErrIPTruncated
+	}
+
 	err = binary.Read(buf, binary.BigEndian, &ip.Identification)
 	if err != nil {
 		return
@@ -69,6 +105,10 @@ func parseIPHeader(buf *bytes.Reader) (ip IP, err error) {
 		return
 	}
 
+	if ip.TimeToLive == 0 {
+		return ip, ErrTTLExpired
+	}
+
 	ip.Protocol, err = buf.ReadByte()
 	if err != nil {
 		return
@@ -89,8 +129,80 @@ func parseIPHeader(buf *bytes.Reader) (ip IP, err error) {
 		return
 	}
 
-	// Jump to the end of the header, which comprises `HeaderLength` 32-bit words
-	buf.Seek(int64(ip.HeaderLength)*4, io.SeekStart)
+	// The rest of the header, which comprises `HeaderLength` 32-bit words, is options
+	options := make([]byte, (int(ip.HeaderLength)-IP_MIN_HEADER_LENGTH)*4)
+	_, err = io.ReadFull(buf, options)
+	if err != nil {
+		return
+	}
+
+	ip.Options, err = parseIPOptions(options)
+	return
+}
+
+func parseIPOptions(options []byte) (parsed []IPOption, err error) {
+	for len(options) > 0 {
+		option := IPOption{Type: options[0]}
+
+		if option.Type == IP_OPTION_END_OF_LIST {
+			return
+		}
+
+		if option.Type == IP_OPTION_NOP {
+			parsed = append(parsed, option)
+			options = options[1:]
+			continue
+		}
+
+		if len(options) < 2 || int(options[1]) < 2 || int(options[1]) > len(options) {
+			return nil, ErrInvalidIPHeader
+		}
+		body := options[2:options[1]]
+		options = options[options[1]:]
+
+		switch option.Type {
+		case IP_OPTION_RECORD_ROUTE:
+			if len(body) < 1 || (len(body)-1)%4 != 0 {
+				return nil, ErrInvalidIPHeader
+			}
+
+			option.Pointer = body[0]
+			for i := 1; i < len(body); i += 4 {
+				option.Route = append(option.Route, binary.BigEndian.Uint32(body[i:]))
+			}
+
+		case IP_OPTION_TIMESTAMP:
+			if len(body) < 2 {
+				return nil, ErrInvalidIPHeader
+			}
+
+			option.Pointer = body[0]
+			option.Overflow = body[1] >> 4
+			option.Flags = body[1] & 0x0F
+
+			size := 4
+			if option.Flags != IP_TIMESTAMP_ONLY {
+				size = 8
+			}
+			if (len(body)-2)%size != 0 {
+				return nil, ErrInvalidIPHeader
+			}
+
+			for i := 2; i < len(body); i += size {
+				var ts IPTimestamp
+				if option.Flags != IP_TIMESTAMP_ONLY {
+					ts.Address = binary.BigEndian.Uint32(body[i:])
+				}
+				ts.Timestamp = binary.BigEndian.Uint32(body[i+size-4:])
+				option.Timestamps = append(option.Timestamps, ts)
+			}
+
+		default:
+			option.Data = append([]byte{}, body...)
+		}
+
+		parsed = append(parsed, option)
+	}
 
 	return
 }
@@ -163,11 +275,48 @@ func parseTCPHeader(buf *bytes.Reader) (tcp TCP, err error) {
 		return
 	}
 
-	// TODO: Parse options
+	if tcp.DataOffset < 5 {
+		return tcp, ErrInvalidTCPHeader
+	}
 
-	// Jump to the end of the header, which comprises `DataOffset` 32-bit words
-	seek := tcp.DataOffset - 5
-	buf.Seek(int64(seek)*4, io.SeekCurrent)
+	// The rest of the header, which comprises `DataOffset` 32-bit words, is options
+	options := make([]byte, (int(tcp.DataOffset)-5)*4)
+	_, err = io.ReadFull(buf, options)
+	if err != nil {
+		return
+	}
 
+	err = parseTCPOptions(&tcp, options)
 	return
 }
+
+func parseTCPOptions(tcp *TCP, options []byte) error {
+	for len(options) > 0 {
+		kind := options[0]
+
+		// End of option list
+		if kind == 0 {
+			return nil
+		}
+
+		// No-operation
+		if kind == 1 {
+			options = options[1:]
+			continue
+		}
+
+		if len(options) < 2 || int(options[1]) < 2 || int(options[1]) > len(options) {
+			return ErrInvalidTCPHeader
+		}
+		length := int(options[1])
+
+		// Maximum segment size
+		if kind == 2 && length == 4 {
+			tcp.MaxSegmentSize = binary.BigEndian.Uint16(options[2:4])
+		}
+
+		options = options[length:]
+	}
+
+	return nil
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"net/netip"
+	"reflect"
+	"testing"
+)
+
+func TestParseIPHeaderOptions(t *testing.T) {
+	// 40 bytes, the most an IPv4 header can carry
+	options := []IPOption{
+		{Type: IP_OPTION_NOP},
+		{Type: IP_OPTION_RECORD_ROUTE, Pointer: 4, Route: []uint32{0}},
+		{Type: IP_OPTION_TIMESTAMP, Pointer: 13, Overflow: 2, Flags: IP_TIMESTAMP_WITH_ADDRS, Timestamps: []IPTimestamp{
+			{Address: 0x0A000001, Timestamp: 86400000},
+		}},
+		{Type: IP_OPTION_TIMESTAMP, Pointer: 5, Timestamps: []IPTimestamp{{}}},
+		{Type: 130, Data: []byte{0xF1, 0x35, 0, 0, 0, 0, 0, 0, 0}}, // Security
+	}
+
+	ip := IP{
+		Version: 4, TimeToLive: 64, Protocol: 6,
+		SourceAddress: 0x0A000001, DestinationAddress: 0x0A000002,
+		Options: options,
+	}
+	ip.TotalLength = uint16(IP_MIN_HEADER_LENGTH*4 + len(ip.serializeOptions()))
+	serialized := ip.Serialize().Bytes()
+
+	if !verifyIPChecksum(serialized) {
+		t.Errorf("checksum doesn't cover the options")
+	}
+
+	parsed, err := parseIPHeader(bytes.NewReader(serialized))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if int(parsed.HeaderLength)*4 != len(serialized) {
+		t.Errorf("header length %d, serialized %d bytes", int(parsed.HeaderLength)*4, len(serialized))
+	}
+	if !reflect.DeepEqual(parsed.Options, options) {
+		t.Errorf("parsed options %+v, want %+v", parsed.Options, options)
+	}
+
+	if reserialized := parsed.Serialize().Bytes(); !bytes.Equal(reserialized, serialized) {
+		t.Errorf("reserialized\n% x\nwant\n% x", reserialized, serialized)
+	}
+}
+
+func TestParseIPOptionsEndOfList(t *testing.T) {
+	// Anything after End of Option List is padding, even if it isn't zero
+	parsed, err := parseIPOptions([]byte{IP_OPTION_NOP, IP_OPTION_END_OF_LIST, 0xFF, 0xFF})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(parsed) != 1 || parsed[0].Type != IP_OPTION_NOP {
+		t.Errorf("parsed %+v, want a single NOP", parsed)
+	}
+
+	// serializeOptions pads with End of Option List
+	ip := IP{Options: []IPOption{{Type: IP_OPTION_NOP}}}
+	if got := ip.serializeOptions(); !bytes.Equal(got, []byte{1, 0, 0, 0}) {
+		t.Errorf("serialized % x, want 01 00 00 00", got)
+	}
+}
+
+func TestParseIPOptionsInvalid(t *testing.T) {
+	for _, options := range [][]byte{
+		{IP_OPTION_RECORD_ROUTE},                         // no length
+		{IP_OPTION_RECORD_ROUTE, 1, 0, 0},                // length shorter than type and length
+		{IP_OPTION_RECORD_ROUTE, 7, 4, 0},                // length past the end
+		{IP_OPTION_RECORD_ROUTE, 2},                      // no pointer
+		{IP_OPTION_RECORD_ROUTE, 6, 4, 0, 0, 0},          // partial address
+		{IP_OPTION_TIMESTAMP, 3, 5, 0},                   // no overflow/flags
+		{IP_OPTION_TIMESTAMP, 8, 5, 1, 0, 0, 0, 0, 0, 0}, // partial address/timestamp pair
+	} {
+		if _, err := parseIPOptions(options); err != ErrInvalidIPHeader {
+			t.Errorf("parseIPOptions(% x) = %v, want %v", options, err, ErrInvalidIPHeader)
+		}
+	}
+}
+
+func TestTCPChecksumCoversOptions(t *testing.T) {
+	source, destination := netip.MustParseAddr("10.0.0.1"), netip.MustParseAddr("10.0.0.2")
+	tcp := TCP{SourcePort: 40000, DestinationPort: 80, SequenceNumber: 1000, ControlBits: 0x02, Window: 1024, MaxSegmentSize: 1460}
+	segment := tcp.Serialize(source, destination, []byte("hello")).Bytes()
+
+	if tcp.DataOffset != 6 || len(segment) != 24+5 {
+		t.Errorf("data offset %d, %d bytes", tcp.DataOffset, len(segment))
+	}
+	if !verifyTCPChecksum(source, destination, segment) {
+		t.Errorf("bad checksum %#04x", tcp.Checksum)
+	}
+
+	parsed, err := parseTCPHeader(bytes.NewReader(segment))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed.MaxSegmentSize != 1460 || parsed.Checksum != tcp.Checksum {
+		t.Errorf("parsed MSS %d, checksum %#04x", parsed.MaxSegmentSize, parsed.Checksum)
+	}
+}
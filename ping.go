@@ -0,0 +1,216 @@
+package main
+
+import (
+	"fmt"
+	"net/netip"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	PING_INTERVAL = 1 * time.Second
+
+	// How long to wait for the last reply before giving up on it
+	PING_TIMEOUT = 2 * time.Second
+
+	// The same as ping(8)'s default
+	PING_PAYLOAD_BYTES = 56
+)
+
+// EchoReply is an answer to one of our echo requests.
+type EchoReply struct {
+	Source   netip.Addr
+	Sequence uint16
+	TTL      uint8
+	Bytes    int
+	RTT      time.Duration
+}
+
+type pendingEcho struct {
+	Destination netip.Addr
+	Sent        time.Time
+	replies     chan<- EchoReply
+}
+
+// Pinger answers echo requests addressed to the stack, and sends its own over
+// either ICMP or ICMPv6.
+type Pinger struct {
+	mu sync.Mutex
+
+	out                *IPOutput
+	LocalIP, LocalIPv6 netip.Addr
+
+	// Identifies our echo requests, like ping(8) uses its pid
+	id       uint16
+	sequence uint16
+	pending  map[uint16]pendingEcho
+}
+
+func NewPinger(out *IPOutput, localIP, localIPv6 netip.Addr) *Pinger {
+	return &Pinger{
+		out:       out,
+		LocalIP:   localIP,
+		LocalIPv6: localIPv6,
+		id:        uint16(os.Getpid()),
+		pending:   make(map[uint16]pendingEcho),
+	}
+}
+
+// Echo answers an echo request with a reply carrying the same identifier,
+// sequence number and data (RFC 792, RFC 4443 §4.2).
+func (p *Pinger) Echo(source, destination netip.Addr, request *ICMP, payload []byte) {
+	reply := ICMP{Type: ICMP_ECHO_REPLY, Rest: request.Rest}
+	if source.Is6() {
+		reply.Type = ICMPV6_ECHO_REPLY
+	}
+
+	switch {
+	case destination == p.LocalIP || destination == p.LocalIPv6:
+
+	case destination == netip.IPv6LinkLocalAllNodes() || destination == solicitedNodeAddress(p.LocalIPv6):
+		// Replies to a multicast echo come from our own address
+		destination = p.LocalIPv6
+
+	default:
+		// Not ours, or a broadcast that would turn us into an amplifier
+		drops.Add(parseLog, "echo request for another address", "src", source, "dst", destination)
+		return
+	}
+
+	err := sendICMP(p.out, destination, source, DEFAULT_TTL, reply, payload)
+	if err != nil {
+		linkLog.Error("failed to send echo reply", "dst", source, "err", err)
+	}
+}
+
+// Reply matches an echo reply against our outstanding requests.
+func (p *Pinger) Reply(source netip.Addr, ttl uint8, reply *ICMP, payload []byte) {
+	now := time.Now()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	pending, ok := p.pending[reply.Sequence()]
+	if reply.Identifier() != p.id || !ok || pending.Destination != source {
+		drops.Add(parseLog, "unexpected echo reply", "src", source, "id", reply.Identifier(), "seq", reply.Sequence())
+		return
+	}
+	delete(p.pending, reply.Sequence())
+
+	pending.replies <- EchoReply{
+		Source: source, Sequence: reply.Sequence(), TTL: ttl,
+		Bytes: len(payload) + 8, RTT: now.Sub(pending.Sent),
+	}
+}
+
+// send sends one echo request. Its reply, if any, is delivered on replies,
+// which must have room for it.
+func (p *Pinger) send(destination netip.Addr, replies chan<- EchoReply) (uint16, error) {
+	p.mu.Lock()
+	sequence := p.sequence
+	p.sequence++
+	p.pending[sequence] = pendingEcho{Destination: destination, Sent: time.Now(), replies: replies}
+	p.mu.Unlock()
+
+	payload := make([]byte, PING_PAYLOAD_BYTES)
+	for i := range payload {
+		payload[i] = byte(i)
+	}
+
+	request := ICMP{Type: ICMP_ECHO_REQUEST, Rest: uint32(p.id)<<16 | uint32(sequence)}
+	source := p.LocalIP
+	if destination.Is6() {
+		request.Type = ICMPV6_ECHO_REQUEST
+		source = p.LocalIPv6
+	}
+
+	err := sendICMP(p.out, source, destination, DEFAULT_TTL, request, payload)
+	if err != nil {
+		p.forget(sequence)
+	}
+
+	return sequence, err
+}
+
+func (p *Pinger) forget(sequence uint16) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	delete(p.pending, sequence)
+}
+
+// Ping sends count echo requests to destination a second apart, printing
+// each reply and then a summary like ping(8).
+func (p *Pinger) Ping(destination netip.Addr, count int) {
+	replies := make(chan EchoReply, count)
+	sequences := []uint16{}
+	rtts := []time.Duration{}
+	attempts := 0
+
+	fmt.Printf("PING %s: %d data bytes\n", destination, PING_PAYLOAD_BYTES)
+
+	ticker := time.NewTicker(PING_INTERVAL)
+	defer ticker.Stop()
+
+	// Set once the last request has been sent
+	var timeout <-chan time.Time
+
+	send := func() {
+		attempts++
+		if attempts == count {
+			timeout = time.After(PING_TIMEOUT)
+		}
+
+		sequence, err := p.send(destination, replies)
+		if err != nil {
+			replLog.Error("failed to send echo request", "dst", destination, "err", err)
+			return
+		}
+		sequences = append(sequences, sequence)
+	}
+
+	send()
+
+wait:
+	for attempts < count || len(rtts) < len(sequences) {
+		select {
+		case r := <-replies:
+			rtts = append(rtts, r.RTT)
+			fmt.Printf("%d bytes from %s: icmp_seq=%d ttl=%d time=%s\n", r.Bytes, r.Source, r.Sequence, r.TTL, r.RTT)
+		case <-ticker.C:
+			if attempts < count {
+				send()
+			}
+		case <-timeout:
+			break wait
+		}
+	}
+
+	for _, sequence := range sequences {
+		p.forget(sequence)
+	}
+
+	fmt.Printf("--- %s ping statistics ---\n", destination)
+	loss := 100.0
+	if len(sequences) > 0 {
+		loss = 100 * float64(len(sequences)-len(rtts)) / float64(len(sequences))
+	}
+	fmt.Printf("%d packets transmitted, %d received, %.0f%% packet loss\n", len(sequences), len(rtts), loss)
+
+	if len(rtts) == 0 {
+		return
+	}
+
+	min, max, total := rtts[0], rtts[0], time.Duration(0)
+	for _, rtt := range rtts {
+		if rtt < min {
+			min = rtt
+		}
+		if rtt > max {
+			max = rtt
+		}
+		total += rtt
+	}
+	fmt.Printf("rtt min/avg/max = %s/%s/%s\n", min, total/time.Duration(len(rtts)), max)
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"fmt"
+	"net/netip"
+	"time"
+)
+
+const (
+	// RFC 4821 §7.2 recommends searching up from a 1024 byte PLPMTU. That's
+	// below IPv6's minimum MTU, so IPv6 starts from the minimum instead.
+	PLPMTUD_BASE_MTU = 1024
+
+	// Consecutive timeouts of full-sized segments before assuming a blackhole
+	PLPMTUD_BLACKHOLE_TIMEOUTS = 2
+
+	// Stop searching once the bounds are this close together
+	PLPMTUD_SEARCH_GRANULARITY = 32
+
+	// How long to wait after a search completes before probing upward again
+	PLPMTUD_RAISE_INTERVAL = 10 * time.Minute
+)
+
+type PLPMTUDState uint8
+
+const (
+	PLPMTUD_DISABLED PLPMTUDState = iota
+	PLPMTUD_SEARCH_COMPLETE
+	PLPMTUD_SEARCHING
+)
+
+var plpmtudStateNames = map[PLPMTUDState]string{
+	PLPMTUD_DISABLED:        "disabled",
+	PLPMTUD_SEARCH_COMPLETE: "search-complete",
+	PLPMTUD_SEARCHING:       "searching",
+}
+
+func (s PLPMTUDState) String() string {
+	if name, ok := plpmtudStateNames[s]; ok {
+		return name
+	}
+	return fmt.Sprintf("PLPMTUDState(%d)", uint8(s))
+}
+
+// PLPMTUD is the packetization layer path MTU discovery state for a
+// connection (RFC 4821). It's used when ICMP is filtered: rather than waiting
+// to be told a segment was too big, the sender notices full-sized segments
+// disappearing and steps its MSS down, then probes with larger segments to
+// find out how far back up it can go. All sizes here are MSS values.
+type PLPMTUD struct {
+	State PLPMTUDState
+
+	// SearchLow is known to get through; SearchHigh is known (or assumed) not to
+	SearchLow, SearchHigh uint16
+
+	// The largest MSS the link and the peer allow
+	MaxMSS uint16
+
+	// The outstanding probe, if Probing
+	Probing   bool
+	ProbeSeq  SeqNum
+	ProbeSize uint16
+
+	ProbesAcked, ProbesLost, Blackholes int
+
+	// When to search upward again after the search completes
+	NextSearch time.Time
+}
+
+// plpmtudBaseMSS is the MSS to fall back to when a blackhole is detected.
+func plpmtudBaseMSS(addr netip.Addr) uint16 {
+	if addr.Is4() {
+		return PLPMTUD_BASE_MTU - headerOverhead(addr)
+	}
+	return DEFAULT_IPV6_MSS
+}
+
+// plpmtudMinMSS is the smallest MSS the search will go down to: what fits in
+// the minimum datagram every IPv4 host accepts, or in IPv6's minimum MTU.
+func plpmtudMinMSS(addr netip.Addr) uint16 {
+	if addr.Is4() {
+		return DEFAULT_MSS
+	}
+	return DEFAULT_IPV6_MSS
+}
+
+func (p *PLPMTUD) finishIfConverged(now time.Time) {
+	if p.SearchHigh-p.SearchLow <= PLPMTUD_SEARCH_GRANULARITY {
+		p.State = PLPMTUD_SEARCH_COMPLETE
+		p.NextSearch = now.Add(PLPMTUD_RAISE_INTERVAL)
+	}
+}
+
+// EnablePLPMTUD starts path MTU discovery for a connection once its MSS is
+// known. linkMSS is the largest MSS the local link allows.
+func (c *Connection) EnablePLPMTUD(linkMSS uint16, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	p := &c.PLPMTUD
+	p.MaxMSS = c.SendMSS
+	if linkMSS < p.MaxMSS {
+		p.MaxMSS = linkMSS
+	}
+
+	p.SearchLow = c.EffectiveMSS()
+	p.SearchHigh = p.MaxMSS + 1
+	p.State = PLPMTUD_SEARCHING
+	p.finishIfConverged(now)
+}
+
+// probeSize returns the size of probe to send next, or 0 if no probe is due.
+func (c *Connection) probeSize(now time.Time) uint16 {
+	p := &c.PLPMTUD
+	if p.State == PLPMTUD_SEARCH_COMPLETE && !now.Before(p.NextSearch) && p.SearchLow < p.MaxMSS {
+		p.State = PLPMTUD_SEARCHING
+		p.SearchHigh = p.MaxMSS + 1
+	}
+
+	if p.State != PLPMTUD_SEARCHING || p.Probing {
+		return 0
+	}
+
+	return p.SearchLow + (p.SearchHigh-p.SearchLow)/2
+}
+
+// startProbe records that a probe of the given size was sent at seq.
+func (c *Connection) startProbe(seq SeqNum, size uint16) {
+	c.PLPMTUD.Probing = true
+	c.PLPMTUD.ProbeSeq = seq
+	c.PLPMTUD.ProbeSize = size
+}
+
+// probeAcked is called when SND.UNA advances. If it covers the outstanding
+// probe, that size is known to work and the MSS is raised to it.
+func (c *Connection) probeAcked(now time.Time) {
+	p := &c.PLPMTUD
+	if !p.Probing || c.SendUnacknowledged.LessThan(p.ProbeSeq.Add(uint32(p.ProbeSize))) {
+		return
+	}
+
+	p.Probing = false
+	p.ProbesAcked++
+	p.SearchLow = p.ProbeSize
+	c.PathMSS = p.ProbeSize
+	p.finishIfConverged(now)
+}
+
+// probeLost is called when the retransmission timer expires. If the oldest
+// unacknowledged segment was a probe, the probe size is too big; that's not
+// a sign of congestion, so it returns true and the timeout doesn't count
+// towards giving up on the connection.
+func (c *Connection) probeLost(now time.Time) bool {
+	p := &c.PLPMTUD
+	if !p.Probing || p.ProbeSeq != c.SendUnacknowledged {
+		return false
+	}
+
+	p.Probing = false
+	p.ProbesLost++
+	p.SearchHigh = p.ProbeSize
+	p.finishIfConverged(now)
+	return true
+}
+
+// detectBlackhole is called after a retransmission timeout of a segment of
+// the given size. If full-sized segments keep disappearing, they're probably
+// being dropped by a router that doesn't send fragmentation needed messages,
+// so the MSS is stepped down and the search starts again from there.
+func (c *Connection) detectBlackhole(size uint32, now time.Time) {
+	p := &c.PLPMTUD
+	mss := c.EffectiveMSS()
+	base, min := plpmtudBaseMSS(c.Quad.SourceIP), plpmtudMinMSS(c.Quad.SourceIP)
+	if p.State == PLPMTUD_DISABLED || c.Retransmits < PLPMTUD_BLACKHOLE_TIMEOUTS || size < uint32(mss) || mss <= min {
+		return
+	}
+
+	next := base
+	if mss <= base {
+		next = mss / 2
+	}
+	if next < min {
+		next = min
+	}
+
+	p.Blackholes++
+	p.State = PLPMTUD_SEARCHING
+	p.SearchLow = next
+	p.SearchHigh = mss
+	c.PathMSS = next
+	p.finishIfConverged(now)
+
+	// Start counting again at the new size
+	c.Retransmits = 0
+}
+
+// pathMTULowered keeps the search in line with an MTU learned from ICMP.
+func (c *Connection) pathMTULowered(mss uint16, now time.Time) {
+	p := &c.PLPMTUD
+	if p.State == PLPMTUD_DISABLED {
+		return
+	}
+
+	p.Probing = false
+	p.SearchLow = mss
+	p.SearchHigh = mss + 1
+	p.finishIfConverged(now)
+}
+
+func (p *PLPMTUD) Inspect() {
+	fmt.Printf("PLPMTUD:            %s (low %d, high %d, max %d)\n", p.State, p.SearchLow, p.SearchHigh, p.MaxMSS)
+	if p.Probing {
+		fmt.Printf("Probe:              %d bytes at %d\n", p.ProbeSize, p.ProbeSeq)
+	}
+	fmt.Printf("Probes:             %d acked, %d lost\n", p.ProbesAcked, p.ProbesLost)
+	fmt.Printf("Blackholes:         %d\n", p.Blackholes)
+}
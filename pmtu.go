@@ -0,0 +1,170 @@
+package main
+
+import (
+	"fmt"
+	"net/netip"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// RFC 1191 §6.3: forget a reduced path MTU after 10 minutes, so we notice
+	// if the path changes back
+	PMTU_AGING = 10 * time.Minute
+
+	// The smallest MTU every IPv4 host must accept (RFC 791)
+	IP_MIN_MTU = 68
+
+	// IPv4 and TCP headers without options
+	TCP_IP_HEADER_LENGTH = 40
+
+	// IPv6 and TCP headers without extension headers or options
+	TCP_IPV6_HEADER_LENGTH = 60
+)
+
+// RFC 1191 §7 plateaus, for routers that don't report the next-hop MTU.
+var mtuPlateaus = []uint16{32000, 17914, 8166, 4352, 2002, 1492, 1006, 508, 296, IP_MIN_MTU}
+
+type pathMTUEntry struct {
+	MTU     uint16
+	Updated time.Time
+}
+
+// PathMTUCache remembers the path MTU learned for each destination.
+type PathMTUCache struct {
+	mu      sync.Mutex
+	entries map[netip.Addr]pathMTUEntry
+}
+
+func NewPathMTUCache() *PathMTUCache {
+	return &PathMTUCache{entries: make(map[netip.Addr]pathMTUEntry)}
+}
+
+// Get returns the path MTU to a destination, or 0 if it isn't known.
+func (p *PathMTUCache) Get(destination netip.Addr, now time.Time) uint16 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	entry, ok := p.entries[destination]
+	if !ok {
+		return 0
+	}
+
+	if now.Sub(entry.Updated) > PMTU_AGING {
+		delete(p.entries, destination)
+		return 0
+	}
+
+	return entry.MTU
+}
+
+// Lower records a smaller path MTU to a destination. Larger values are
+// ignored; the estimate only goes back up when it ages out.
+func (p *PathMTUCache) Lower(destination netip.Addr, mtu uint16, now time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	entry, ok := p.entries[destination]
+	if ok && now.Sub(entry.Updated) <= PMTU_AGING && entry.MTU <= mtu {
+		return
+	}
+
+	p.entries[destination] = pathMTUEntry{MTU: mtu, Updated: now}
+}
+
+func (p *PathMTUCache) Inspect() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	destinations := make([]netip.Addr, 0, len(p.entries))
+	for destination := range p.entries {
+		destinations = append(destinations, destination)
+	}
+	sort.Slice(destinations, func(i, j int) bool { return destinations[i].Less(destinations[j]) })
+
+	fmt.Printf("%d path MTUs:\n", len(destinations))
+	for _, destination := range destinations {
+		entry := p.entries[destination]
+		fmt.Printf("%s: %d (updated %s)\n", destination, entry.MTU, entry.Updated.Format(time.StampMilli))
+	}
+}
+
+// headerOverhead is the size of the IP and TCP headers in a segment to addr,
+// i.e. the difference between the MTU and the MSS.
+func headerOverhead(addr netip.Addr) uint16 {
+	if addr.Is4() {
+		return TCP_IP_HEADER_LENGTH
+	}
+	return TCP_IPV6_HEADER_LENGTH
+}
+
+// estimatePathMTU picks the next plateau below the size of the datagram that
+// was too big, for ICMP messages that don't carry the next-hop MTU.
+func estimatePathMTU(totalLength uint16) uint16 {
+	for _, plateau := range mtuPlateaus {
+		if plateau < totalLength {
+			return plateau
+		}
+	}
+	return IP_MIN_MTU
+}
+
+// LowerPathMTU applies a fragmentation needed message quoting the segment with
+// sequence number seq. It returns false if the quoted segment isn't one we're
+// waiting on an ACK for (RFC 5927 §4.1), or if the MTU isn't an improvement.
+func (c *Connection) LowerPathMTU(seq SeqNum, mtu uint16) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !seq.Between(c.SendUnacknowledged, c.SendNext) {
+		return false
+	}
+
+	mss := mtu - headerOverhead(c.Quad.SourceIP)
+	if mss >= c.EffectiveMSS() {
+		return false
+	}
+
+	c.PathMSS = mss
+	c.pathMTULowered(mss, time.Now())
+	return true
+}
+
+// FragmentationNeeded handles an ICMP fragmentation needed message (RFC 1191)
+// for one of our segments: the connection's MSS is lowered to fit, and
+// everything in flight is retransmitted straight away.
+func (c *Connections) FragmentationNeeded(q quotedSegment, mtu uint16) {
+	if mtu == 0 {
+		mtu = estimatePathMTU(q.IP.TotalLength)
+	}
+
+	if mtu < IP_MIN_MTU {
+		drops.Add(tcpLog, "ICMP with invalid MTU", "quad", q.Quad, "mtu", mtu)
+		return
+	}
+
+	c.mu.Lock()
+	conn, ok := c.m[q.Quad]
+	c.mu.Unlock()
+
+	if !ok {
+		drops.Add(tcpLog, "ICMP for unknown connection", "quad", q.Quad)
+		return
+	}
+
+	if !conn.LowerPathMTU(q.SequenceNumber, mtu) {
+		drops.Add(conn.Logger(), "ICMP for unexpected segment", "seq", q.SequenceNumber, "mtu", mtu)
+		return
+	}
+
+	c.pmtu.Lower(q.Quad.SourceIP, mtu, time.Now())
+
+	for _, segment := range conn.Retransmit(q.Quad) {
+		err := c.Send(segment.Quad, segment.TCP, segment.Payload)
+		if err != nil {
+			conn.Logger().Error("failed to retransmit", "err", err)
+			return
+		}
+	}
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// RFC 791 suggests 15 seconds; this matches Linux's ipfrag_time
+	REASSEMBLY_TIMEOUT = 30 * time.Second
+
+	// Total payload buffered across all incomplete datagrams
+	REASSEMBLY_MAX_MEMORY = 256 * 1024
+
+	// Incomplete datagrams tracked at once, whether or not they're holding
+	// any memory
+	REASSEMBLY_MAX_DATAGRAMS = 1024
+
+	IP_MAX_DATAGRAM_LENGTH = 65535
+)
+
+var ErrFragmentOverlap = fmt.Errorf("overlapping IP fragment")
+var ErrFragmentInvalid = fmt.Errorf("invalid IP fragment")
+var ErrReassemblyMemory = fmt.Errorf("IP reassembly memory exhausted")
+
+// IsFragment reports whether ip is part of a fragmented datagram: either MF is
+// set or it doesn't start at offset zero.
+func (ip *IP) IsFragment() bool {
+	return ip.Flags&0x01 == 0x01 || ip.FragmentOffset != 0
+}
+
+type fragmentKey struct {
+	SourceAddress, DestinationAddress uint32
+	Protocol                          uint8
+	Identification                    uint16
+}
+
+type fragment struct {
+	offset int
+	data   []byte
+}
+
+type reassembly struct {
+	// The header of the fragment at offset zero, once it's arrived
+	header    IP
+	haveFirst bool
+
+	// Sorted by offset, never overlapping
+	fragments []fragment
+	size      int
+
+	// The length of the whole payload, once the last fragment has arrived
+	length int
+
+	deadline time.Time
+
+	// Set when an overlapping fragment arrives. Per RFC 5722 the whole
+	// datagram is discarded, and so are any further fragments of it until
+	// the timer expires.
+	discarded bool
+}
+
+// Reassembler collects IPv4 fragments until a whole datagram has arrived.
+type Reassembler struct {
+	mu sync.Mutex
+
+	pending map[fragmentKey]*reassembly
+	memory  int
+
+	MaxMemory int
+	Timeout   time.Duration
+}
+
+func NewReassembler(maxMemory int, timeout time.Duration) *Reassembler {
+	return &Reassembler{
+		pending:   make(map[fragmentKey]*reassembly),
+		MaxMemory: maxMemory,
+		Timeout:   timeout,
+	}
+}
+
+// Add buffers a fragment with the given header and payload. Once every
+// fragment of the datagram has arrived, it returns the reassembled header and
+// payload with complete set.
+func (r *Reassembler) Add(ip IP, payload []byte, now time.Time) (datagram IP, data []byte, complete bool, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.expire(now)
+
+	offset := int(ip.FragmentOffset) * 8
+	more := ip.Flags&0x01 == 0x01
+
+	// Every fragment but the last must carry a non-zero multiple of 8 bytes
+	if (more && (len(payload) == 0 || len(payload)%8 != 0)) || offset+len(payload) > IP_MAX_DATAGRAM_LENGTH-int(ip.HeaderLength)*4 {
+		return datagram, nil, false, ErrFragmentInvalid
+	}
+
+	key := fragmentKey{
+		SourceAddress: ip.SourceAddress, DestinationAddress: ip.DestinationAddress,
+		Protocol: ip.Protocol, Identification: ip.Identification,
+	}
+
+	re, ok := r.pending[key]
+	if !ok {
+		if len(r.pending) >= REASSEMBLY_MAX_DATAGRAMS {
+			r.evictOldest(nil)
+		}
+
+		re = &reassembly{length: -1, deadline: now.Add(r.Timeout)}
+		r.pending[key] = re
+	}
+
+	if re.discarded {
+		return datagram, nil, false, ErrFragmentOverlap
+	}
+
+	if !more {
+		if re.length != -1 && re.length != offset+len(payload) {
+			r.discard(re)
+			return datagram, nil, false, ErrFragmentOverlap
+		}
+		re.length = offset + len(payload)
+
+		// Fragments already buffered can't run past the end either
+		if n := len(re.fragments); n > 0 && re.fragments[n-1].offset+len(re.fragments[n-1].data) > re.length {
+			r.discard(re)
+			return datagram, nil, false, ErrFragmentOverlap
+		}
+	}
+
+	if re.length != -1 && offset+len(payload) > re.length {
+		r.discard(re)
+		return datagram, nil, false, ErrFragmentOverlap
+	}
+
+	i := sort.Search(len(re.fragments), func(i int) bool { return re.fragments[i].offset >= offset })
+
+	// An exact duplicate (e.g. a retransmission by a lower layer) is harmless
+	if i < len(re.fragments) && re.fragments[i].offset == offset && bytes.Equal(re.fragments[i].data, payload) {
+		return datagram, nil, false, nil
+	}
+
+	if (i > 0 && re.fragments[i-1].offset+len(re.fragments[i-1].data) > offset) ||
+		(i < len(re.fragments) && offset+len(payload) > re.fragments[i].offset) {
+		r.discard(re)
+		return datagram, nil, false, ErrFragmentOverlap
+	}
+
+	// Make room by giving up on the oldest datagrams, so one sender that
+	// never finishes its datagrams can't block reassembly for everyone else
+	for r.memory+len(payload) > r.MaxMemory {
+		if !r.evictOldest(re) {
+			return datagram, nil, false, ErrReassemblyMemory
+		}
+	}
+
+	re.fragments = append(re.fragments, fragment{})
+	copy(re.fragments[i+1:], re.fragments[i:])
+	re.fragments[i] = fragment{offset: offset, data: append([]byte{}, payload...)}
+	re.size += len(payload)
+	r.memory += len(payload)
+
+	if offset == 0 {
+		re.header = ip
+		re.haveFirst = true
+	}
+
+	if !re.haveFirst || re.length == -1 || !re.contiguous() {
+		return datagram, nil, false, nil
+	}
+
+	data = make([]byte, 0, re.length)
+	for _, f := range re.fragments {
+		data = append(data, f.data...)
+	}
+
+	datagram = re.header
+	datagram.Flags &^= 0x01
+	datagram.FragmentOffset = 0
+	datagram.TotalLength = uint16(int(datagram.HeaderLength)*4 + len(data))
+
+	r.memory -= re.size
+	delete(r.pending, key)
+
+	return datagram, data, true, nil
+}
+
+// contiguous reports whether the fragments cover the whole payload without
+// any holes.
+func (re *reassembly) contiguous() bool {
+	end := 0
+	for _, f := range re.fragments {
+		if f.offset != end {
+			return false
+		}
+		end += len(f.data)
+	}
+	return end == re.length
+}
+
+// discard frees a datagram's fragments but keeps its entry until it times out,
+// so later fragments of it are dropped too.
+func (r *Reassembler) discard(re *reassembly) {
+	r.memory -= re.size
+	re.fragments = nil
+	re.size = 0
+	re.discarded = true
+}
+
+// evictOldest gives up on the incomplete datagram that started first, other
+// than keep. It returns false if there's nothing else to evict.
+func (r *Reassembler) evictOldest(keep *reassembly) bool {
+	var oldestKey fragmentKey
+	var oldest *reassembly
+	for key, re := range r.pending {
+		if re != keep && (oldest == nil || re.deadline.Before(oldest.deadline)) {
+			oldestKey, oldest = key, re
+		}
+	}
+
+	if oldest == nil {
+		return false
+	}
+
+	if !oldest.discarded {
+		drops.Add(parseLog, "IP reassembly evicted", "src", addrFromUint32(oldestKey.SourceAddress), "dst", addrFromUint32(oldestKey.DestinationAddress), "id", oldestKey.Identification)
+	}
+	r.memory -= oldest.size
+	delete(r.pending, oldestKey)
+	return true
+}
+
+func (r *Reassembler) expire(now time.Time) {
+	for key, re := range r.pending {
+		if now.After(re.deadline) {
+			if !re.discarded {
+				drops.Add(parseLog, "IP reassembly timeout", "src", addrFromUint32(key.SourceAddress), "dst", addrFromUint32(key.DestinationAddress), "id", key.Identification)
+			}
+			r.memory -= re.size
+			delete(r.pending, key)
+		}
+	}
+}
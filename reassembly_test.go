@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+var reassemblyPayload = []byte("0123456789abcdefghijklmnopqrstuv")
+
+// addFragment adds reassemblyPayload[start:end] as a fragment of datagram id.
+func addFragment(r *Reassembler, id uint16, start, end int, more bool, now time.Time) (IP, []byte, bool, error) {
+	ip := IP{
+		Version: 4, HeaderLength: IP_MIN_HEADER_LENGTH, TimeToLive: 64, Protocol: 17,
+		Identification: id, FragmentOffset: uint16(start / 8),
+		SourceAddress: 0x0A000001, DestinationAddress: 0x0A000002,
+	}
+	if more {
+		ip.Flags |= 0x01
+	}
+	return r.Add(ip, reassemblyPayload[start:end], now)
+}
+
+func TestReassemblyOutOfOrder(t *testing.T) {
+	r := NewReassembler(REASSEMBLY_MAX_MEMORY, REASSEMBLY_TIMEOUT)
+	now := time.Now()
+
+	// Last, first, then the middle
+	if _, _, complete, err := addFragment(r, 1, 24, 32, false, now); complete || err != nil {
+		t.Fatalf("[24,32): complete = %v, err = %v", complete, err)
+	}
+	if _, _, complete, err := addFragment(r, 1, 0, 8, true, now); complete || err != nil {
+		t.Fatalf("[0,8): complete = %v, err = %v", complete, err)
+	}
+
+	datagram, data, complete, err := addFragment(r, 1, 8, 24, true, now)
+	if err != nil || !complete {
+		t.Fatalf("complete = %v, err = %v", complete, err)
+	}
+	if !bytes.Equal(data, reassemblyPayload) {
+		t.Errorf("reassembled %q, want %q", data, reassemblyPayload)
+	}
+	if datagram.IsFragment() || datagram.TotalLength != 20+32 {
+		t.Errorf("reassembled header has flags %d, offset %d, total length %d", datagram.Flags, datagram.FragmentOffset, datagram.TotalLength)
+	}
+	if len(r.pending) != 0 || r.memory != 0 {
+		t.Errorf("%d datagrams and %d bytes still pending", len(r.pending), r.memory)
+	}
+}
+
+func TestReassemblyDuplicate(t *testing.T) {
+	r := NewReassembler(REASSEMBLY_MAX_MEMORY, REASSEMBLY_TIMEOUT)
+	now := time.Now()
+
+	addFragment(r, 1, 0, 16, true, now)
+	if _, _, _, err := addFragment(r, 1, 0, 16, true, now); err != nil {
+		t.Fatalf("exact duplicate: %s", err)
+	}
+	if _, data, complete, err := addFragment(r, 1, 16, 32, false, now); err != nil || !complete || !bytes.Equal(data, reassemblyPayload) {
+		t.Errorf("complete = %v, err = %v, data %q", complete, err, data)
+	}
+}
+
+func TestReassemblyOverlap(t *testing.T) {
+	tests := []struct {
+		name      string
+		fragments [][3]int // start, end, more
+	}{
+		{"overlapping the previous fragment", [][3]int{{0, 16, 1}, {8, 32, 0}}},
+		{"overlapping the next fragment", [][3]int{{16, 32, 0}, {0, 24, 1}}},
+		{"inside another fragment", [][3]int{{0, 24, 1}, {8, 16, 1}}},
+		{"past the last fragment", [][3]int{{8, 16, 0}, {16, 24, 1}}},
+		{"two last fragments", [][3]int{{16, 24, 0}, {24, 32, 0}}},
+
+		// A fragment already buffered past where the last one ends; the
+		// sizes would add up to a 24 byte datagram with a hole at [8,16)
+		{"buffered past the last fragment", [][3]int{{24, 32, 1}, {16, 24, 0}}},
+	}
+
+	for _, test := range tests {
+		r := NewReassembler(REASSEMBLY_MAX_MEMORY, REASSEMBLY_TIMEOUT)
+		now := time.Now()
+
+		var err error
+		for _, f := range test.fragments {
+			_, _, _, err = addFragment(r, 1, f[0], f[1], f[2] == 1, now)
+		}
+		if err != ErrFragmentOverlap {
+			t.Errorf("%s: err = %v, want %v", test.name, err, ErrFragmentOverlap)
+		}
+
+		// The rest of the datagram is dropped until it times out
+		if _, _, complete, err := addFragment(r, 1, 0, 8, true, now); complete || err != ErrFragmentOverlap {
+			t.Errorf("%s: after overlap, complete = %v, err = %v", test.name, complete, err)
+		}
+		if r.memory != 0 {
+			t.Errorf("%s: %d bytes still buffered", test.name, r.memory)
+		}
+
+		if _, _, _, err := addFragment(r, 1, 0, 8, true, now.Add(REASSEMBLY_TIMEOUT+time.Second)); err != nil {
+			t.Errorf("%s: after timeout: %s", test.name, err)
+		}
+	}
+}
+
+func TestReassemblyInvalid(t *testing.T) {
+	r := NewReassembler(REASSEMBLY_MAX_MEMORY, REASSEMBLY_TIMEOUT)
+	now := time.Now()
+
+	if _, _, _, err := addFragment(r, 1, 8, 8, true, now); err != ErrFragmentInvalid {
+		t.Errorf("empty non-final fragment: err = %v", err)
+	}
+	if _, _, _, err := addFragment(r, 1, 0, 12, true, now); err != ErrFragmentInvalid {
+		t.Errorf("non-final fragment of 12 bytes: err = %v", err)
+	}
+	if len(r.pending) != 0 {
+		t.Errorf("%d datagrams pending after invalid fragments", len(r.pending))
+	}
+}
+
+func TestReassemblyEviction(t *testing.T) {
+	r := NewReassembler(16, REASSEMBLY_TIMEOUT)
+	now := time.Now()
+
+	// Datagram 1 holds all the memory and never completes, so datagram 2
+	// pushes it out
+	if _, _, _, err := addFragment(r, 1, 0, 16, true, now); err != nil {
+		t.Fatal(err)
+	}
+	now = now.Add(time.Second)
+	if _, _, _, err := addFragment(r, 2, 0, 8, true, now); err != nil {
+		t.Fatalf("datagram 2: %s", err)
+	}
+	if _, ok := r.pending[fragmentKey{0x0A000001, 0x0A000002, 17, 1}]; ok {
+		t.Errorf("datagram 1 not evicted")
+	}
+
+	if _, data, complete, err := addFragment(r, 2, 8, 16, false, now); err != nil || !complete || !bytes.Equal(data, reassemblyPayload[:16]) {
+		t.Errorf("datagram 2: complete = %v, err = %v, data %q", complete, err, data)
+	}
+
+	// A single fragment larger than the limit can't fit however much is
+	// evicted
+	if _, _, _, err := addFragment(r, 3, 0, 24, true, now); err != ErrReassemblyMemory {
+		t.Errorf("datagram 3: err = %v, want %v", err, ErrReassemblyMemory)
+	}
+}
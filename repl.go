@@ -3,111 +3,407 @@ package main
 import (
 	"bufio"
 	"fmt"
-	"log"
+	"net"
+	"net/netip"
 	"os"
 	"strconv"
 	"strings"
-
-	"github.com/songgao/water"
 )
 
-func dispatch(line string, iface *water.Interface, connections *Connections) {
+// stopEvents unsubscribes the REPL from connection events, if it's subscribed.
+var stopEvents func()
+
+func dispatch(line string, connections *Connections) {
 	if line == "c" || line == "connections" {
 		connections.Inspect()
 	}
 
-	if strings.HasPrefix(line, "close") {
+	if strings.HasPrefix(line, "conn ") {
 		words := strings.Split(line, " ")
 		if len(words) != 2 {
-			fmt.Fprintf(os.Stderr, "usage: close <conn_id>\n")
+			fmt.Fprintf(os.Stderr, "usage: conn <conn_id>\n")
+			return
+		}
+
+		connId, err := strconv.ParseInt(words[1], 10, 64)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "conn_id must be a number\n")
+			return
+		}
+
+		_, conn, err := connections.Get(int(connId))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+			return
+		}
+
+		conn.Inspect()
+	}
+
+	if line == "events" {
+		if stopEvents != nil {
+			stopEvents()
+			stopEvents = nil
+			return
+		}
+
+		events, stop := connections.Subscribe(64)
+		stopEvents = stop
+		go func() {
+			for e := range events {
+				fmt.Println(e)
+			}
+		}()
+	}
+
+	if line == "d" || line == "drops" {
+		drops.Inspect()
+	}
+
+	if strings.HasPrefix(line, "df") {
+		words := strings.Split(line, " ")
+		if len(words) != 3 || (words[2] != "on" && words[2] != "off") {
+			fmt.Fprintf(os.Stderr, "usage: df <conn_id> on|off\n")
 			return
 		}
 
 		connId, err := strconv.ParseInt(words[1], 10, 64)
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "conn_id must be a number")
+			fmt.Fprintf(os.Stderr, "conn_id must be a number\n")
 			return
 		}
 
-		quad := connections.ids[connId]
-		respTcp, err := connections.m[quad].Close(quad)
+		_, conn, err := connections.Get(int(connId))
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "failed to close conn: %s", err.Error())
+			fmt.Fprintf(os.Stderr, "%s\n", err.Error())
 			return
 		}
 
-		respIp := IP{
-			Version:            4,
-			HeaderLength:       5,
-			TotalLength:        (10 * 4),
-			TimeToLive:         64,
-			Flags:              2,
-			Protocol:           6,
-			SourceAddress:      quad.DestinationIP,
-			DestinationAddress: quad.SourceIP,
+		conn.SetDontFragment(words[2] == "on")
+	}
+
+	if strings.HasPrefix(line, "trace") {
+		words := strings.Split(line, " ")
+		if len(words) < 2 || len(words) > 3 || (words[len(words)-1] != "on" && words[len(words)-1] != "off") {
+			fmt.Fprintf(os.Stderr, "usage: trace [conn_id] on|off\n")
+			return
 		}
 
-		response := respIp.Serialize()
-		response.Write(respTcp.Serialize(&respIp, []byte{}).Bytes())
+		on := words[len(words)-1] == "on"
+		if len(words) == 2 {
+			connections.SetTrace(on)
+			return
+		}
+
+		connId, err := strconv.ParseInt(words[1], 10, 64)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "conn_id must be a number\n")
+			return
+		}
+
+		_, conn, err := connections.Get(int(connId))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+			return
+		}
+
+		conn.SetTrace(on)
+	}
+
+	if strings.HasPrefix(line, "ping") {
+		words := strings.Split(line, " ")
+		if len(words) != 2 && len(words) != 3 {
+			fmt.Fprintf(os.Stderr, "usage: ping <addr> [count]\n")
+			return
+		}
 
-		_, err = response.WriteTo(iface)
+		destination, err := netip.ParseAddr(words[1])
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "failed to write TCP data on the wire %s", err.Error())
+			fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+			return
+		}
+
+		count := 4
+		if len(words) == 3 {
+			count, err = strconv.Atoi(words[2])
+			if err != nil || count < 1 {
+				fmt.Fprintf(os.Stderr, "count must be a positive number\n")
+				return
+			}
+		}
+
+		go connections.Ping(destination, count)
+	}
+
+	if strings.HasPrefix(line, "udp ") {
+		dispatchUDP(strings.Split(line, " "), connections)
+	}
+
+	if line == "capture" {
+		connections.Capture.Inspect()
+	}
+
+	if strings.HasPrefix(line, "capture ") {
+		words := strings.Split(line, " ")
+		switch {
+		case words[1] == "stop" && len(words) == 2:
+			err := connections.Capture.Stop()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+			}
+
+		case words[1] == "start" && len(words) >= 3:
+			filter, err := parseCaptureFilter(words[3:])
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+				return
+			}
+
+			err = connections.Capture.Start(words[2], filter)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+			}
+
+		default:
+			fmt.Fprintf(os.Stderr, "usage: capture start <file> [host <addr>] [port <port>] [quad <addr:port> <addr:port>] | capture stop\n")
+		}
+	}
+
+	if line == "arp" {
+		connections.InspectLink()
+	}
+
+	if line == "log" {
+		InspectLogLevels()
+	}
+
+	if strings.HasPrefix(line, "log ") {
+		words := strings.Split(line, " ")
+		if len(words) != 2 && len(words) != 3 {
+			fmt.Fprintf(os.Stderr, "usage: log [parse|tcp|repl|link] <level>\n")
 			return
 		}
+
+		subsystem := ""
+		if len(words) == 3 {
+			subsystem = words[1]
+		}
+
+		err := SetLogLevel(subsystem, words[len(words)-1])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+		}
 	}
 
-	if strings.HasPrefix(line, "write") {
+	if line == "pmtu" {
+		connections.InspectPathMTU()
+	}
+
+	if line == "h" || line == "history" {
+		connections.InspectHistory()
+	}
+
+	if line == "l" || line == "listeners" {
+		connections.InspectListeners()
+	}
+
+	if strings.HasPrefix(line, "listen") && line != "listeners" {
+		words := strings.Split(line, " ")
+		if len(words) != 4 {
+			fmt.Fprintf(os.Stderr, "usage: listen <port> <syn_backlog> <accept_backlog>\n")
+			return
+		}
+
+		port, err := strconv.ParseUint(words[1], 10, 16)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "port must be a number\n")
+			return
+		}
+
+		synBacklog, err := strconv.Atoi(words[2])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "syn_backlog must be a number\n")
+			return
+		}
+
+		acceptBacklog, err := strconv.Atoi(words[3])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "accept_backlog must be a number\n")
+			return
+		}
+
+		connections.Listen(uint16(port), synBacklog, acceptBacklog)
+	}
+
+	if strings.HasPrefix(line, "accept") {
+		words := strings.Split(line, " ")
+		if len(words) != 2 {
+			fmt.Fprintf(os.Stderr, "usage: accept <port>\n")
+			return
+		}
+
+		port, err := strconv.ParseUint(words[1], 10, 16)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "port must be a number\n")
+			return
+		}
+
+		connId, err := connections.Accept(uint16(port))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+			return
+		}
+
+		fmt.Printf("accepted connection %d\n", connId)
+	}
+
+	if strings.HasPrefix(line, "close") || strings.HasPrefix(line, "shutdown") {
+		words := strings.Split(line, " ")
+		if len(words) != 2 {
+			fmt.Fprintf(os.Stderr, "usage: %s <conn_id>\n", words[0])
+			return
+		}
+
+		connId, err := strconv.ParseInt(words[1], 10, 64)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "conn_id must be a number\n")
+			return
+		}
+
+		quad, conn, err := connections.Get(int(connId))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+			return
+		}
+
+		close := conn.Close
+		if words[0] == "shutdown" {
+			close = conn.CloseWrite
+		}
+
+		respTcp, err := close(quad)
+		if err != nil {
+			conn.Logger().Error("failed to close connection", "err", err)
+			return
+		}
+
+		if respTcp == (TCP{}) {
+			return
+		}
+
+		err = connections.Send(quad, respTcp, []byte{})
+		if err != nil {
+			conn.Logger().Error("failed to send segment", "err", err)
+			return
+		}
+	}
+
+	if strings.HasPrefix(line, "write") || strings.HasPrefix(line, "urgent") {
 		words := strings.Split(line, " ")
 		if len(words) != 3 {
-			fmt.Fprintf(os.Stderr, "usage: write <conn_id> <text>\n")
+			fmt.Fprintf(os.Stderr, "usage: %s <conn_id> <text>\n", words[0])
 			return
 		}
 
 		connId, err := strconv.ParseInt(words[1], 10, 64)
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "conn_id must be a number")
+			fmt.Fprintf(os.Stderr, "conn_id must be a number\n")
 			return
 		}
 		text := []byte(strings.TrimSpace(words[2]) + "\n")
 
-		quad := connections.ids[connId]
-		respTcp, err := connections.m[quad].Write(text, quad)
+		quad, conn, err := connections.Get(int(connId))
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "failed to send data: %s", err.Error())
+			fmt.Fprintf(os.Stderr, "%s\n", err.Error())
 			return
 		}
 
-		respIp := IP{
-			Version:            4,
-			HeaderLength:       5,
-			TotalLength:        (10 * 4) + uint16(len(text)),
-			TimeToLive:         64,
-			Flags:              2,
-			Protocol:           6,
-			SourceAddress:      quad.DestinationIP,
-			DestinationAddress: quad.SourceIP,
+		write := conn.Write
+		if words[0] == "urgent" {
+			write = conn.WriteUrgent
+		}
+
+		segments, err := write(text, quad)
+		if err != nil {
+			conn.Logger().Error("failed to send data", "err", err)
+			return
 		}
 
-		response := respIp.Serialize()
-		response.Write(respTcp.Serialize(&respIp, text).Bytes())
+		for _, segment := range segments {
+			err = connections.Send(quad, segment.TCP, segment.Payload)
+			if err != nil {
+				conn.Logger().Error("failed to send segment", "err", err)
+				return
+			}
+		}
+	}
+}
 
-		_, err = response.WriteTo(iface)
+// dispatchUDP handles "udp bind <port>", "udp send <port> <addr:port> <text>"
+// and "udp close <port>".
+func dispatchUDP(words []string, connections *Connections) {
+	if len(words) < 3 {
+		fmt.Fprintf(os.Stderr, "usage: udp bind|send|close <port> ...\n")
+		return
+	}
+
+	port, err := strconv.ParseUint(words[2], 10, 16)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "port must be a number\n")
+		return
+	}
+
+	if words[1] == "bind" {
+		conn, err := connections.UDP().Bind(uint16(port))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+			return
+		}
+
+		go printDatagrams(conn)
+		return
+	}
+
+	conn, err := connections.UDP().Get(uint16(port))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+		return
+	}
+
+	switch words[1] {
+	case "close":
+		conn.Close()
+
+	case "send":
+		if len(words) != 5 {
+			fmt.Fprintf(os.Stderr, "usage: udp send <port> <addr:port> <text>\n")
+			return
+		}
+
+		to, err := netip.ParseAddrPort(words[3])
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "failed to write TCP data on the wire %s", err.Error())
+			fmt.Fprintf(os.Stderr, "%s\n", err.Error())
 			return
 		}
+
+		_, err = conn.WriteTo([]byte(words[4]+"\n"), net.UDPAddrFromAddrPort(to))
+		if err != nil {
+			replLog.Error("failed to send datagram", "port", port, "to", to, "err", err)
+		}
+
+	default:
+		fmt.Fprintf(os.Stderr, "usage: udp bind|send|close <port> ...\n")
 	}
 }
 
-func repl(iface *water.Interface, connections *Connections) {
+func repl(connections *Connections) {
 	reader := bufio.NewReader(os.Stdin)
 	for {
 		fmt.Print("> ")
 		line, err := reader.ReadString('\n')
 		if err != nil {
-			log.Fatal(err)
+			fatal(replLog, "failed to read command", "err", err)
 		}
-		dispatch(strings.TrimSpace(line), iface, connections)
+		dispatch(strings.TrimSpace(line), connections)
 	}
 }
@@ -2,7 +2,9 @@
 
 sudo ip tuntap add user tim mode tun tun_tcp
 sudo ip addr add 10.0.0.1/24 dev tun_tcp
+sudo ip -6 addr add fd00::1/64 dev tun_tcp
 sudo ip link set tun_tcp up
 
 go build
-./tcp
\ No newline at end of file
+./tcp
+# TAP mode: create tap_tcp instead, attach it to a bridge and run ./tcp -tap
@@ -0,0 +1,40 @@
+package main
+
+// SeqNum is a TCP sequence number. Sequence space wraps around at 2^32 (RFC
+// 9293 §3.4), so comparisons must go through these helpers instead of < and >.
+type SeqNum uint32
+
+func (s SeqNum) Add(n uint32) SeqNum {
+	return s + SeqNum(n)
+}
+
+// Diff returns the distance from t forward to s.
+func (s SeqNum) Diff(t SeqNum) uint32 {
+	return uint32(s - t)
+}
+
+func (s SeqNum) LessThan(t SeqNum) bool {
+	return int32(s-t) < 0
+}
+
+func (s SeqNum) LessThanEq(t SeqNum) bool {
+	return int32(s-t) <= 0
+}
+
+func (s SeqNum) GreaterThan(t SeqNum) bool {
+	return int32(s-t) > 0
+}
+
+func (s SeqNum) GreaterThanEq(t SeqNum) bool {
+	return int32(s-t) >= 0
+}
+
+// Between reports whether lo <= s < hi.
+func (s SeqNum) Between(lo, hi SeqNum) bool {
+	return s.Diff(lo) < hi.Diff(lo)
+}
+
+// InWindow reports whether start <= s < start+size.
+func (s SeqNum) InWindow(start SeqNum, size uint32) bool {
+	return s.Diff(start) < size
+}
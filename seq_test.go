@@ -0,0 +1,63 @@
+package main
+
+import "testing"
+
+func TestSeqNumWraparound(t *testing.T) {
+	tests := []struct {
+		name        string
+		s, t        SeqNum
+		lessThan    bool
+		greaterThan bool
+		diff        uint32
+	}{
+		{"equal", 100, 100, false, false, 0},
+		{"ordinary", 100, 200, true, false, 4294967196},
+		{"across wrap", 0xFFFFFFF0, 0x10, true, false, 0xFFFFFFE0},
+		{"after wrap", 0x10, 0xFFFFFFF0, false, true, 0x20},
+		{"max to zero", 0xFFFFFFFF, 0, true, false, 0xFFFFFFFF},
+		{"half space", 0, 0x7FFFFFFF, true, false, 0x80000001},
+	}
+
+	for _, test := range tests {
+		if got := test.s.LessThan(test.t); got != test.lessThan {
+			t.Errorf("%s: %d.LessThan(%d) = %v", test.name, test.s, test.t, got)
+		}
+		if got := test.s.GreaterThan(test.t); got != test.greaterThan {
+			t.Errorf("%s: %d.GreaterThan(%d) = %v", test.name, test.s, test.t, got)
+		}
+		if got := test.s.LessThanEq(test.t); got != (test.lessThan || test.s == test.t) {
+			t.Errorf("%s: %d.LessThanEq(%d) = %v", test.name, test.s, test.t, got)
+		}
+		if got := test.s.GreaterThanEq(test.t); got != (test.greaterThan || test.s == test.t) {
+			t.Errorf("%s: %d.GreaterThanEq(%d) = %v", test.name, test.s, test.t, got)
+		}
+		if got := test.s.Diff(test.t); got != test.diff {
+			t.Errorf("%s: %d.Diff(%d) = %d, want %d", test.name, test.s, test.t, got, test.diff)
+		}
+	}
+}
+
+func TestSeqNumWindow(t *testing.T) {
+	tests := []struct {
+		s, start SeqNum
+		size     uint32
+		want     bool
+	}{
+		{0xFFFFFFF0, 0xFFFFFFF0, 0x20, true},
+		{0xFFFFFFFF, 0xFFFFFFF0, 0x20, true},
+		{0, 0xFFFFFFF0, 0x20, true},
+		{0xF, 0xFFFFFFF0, 0x20, true},
+		{0x10, 0xFFFFFFF0, 0x20, false},
+		{0xFFFFFFEF, 0xFFFFFFF0, 0x20, false},
+		{5, 5, 0, false},
+	}
+
+	for _, test := range tests {
+		if got := test.s.InWindow(test.start, test.size); got != test.want {
+			t.Errorf("%d.InWindow(%d, %d) = %v, want %v", test.s, test.start, test.size, got, test.want)
+		}
+		if got := test.s.Between(test.start, test.start.Add(test.size)); got != test.want {
+			t.Errorf("%d.Between(%d, %d) = %v, want %v", test.s, test.start, test.start.Add(test.size), got, test.want)
+		}
+	}
+}
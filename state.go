@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+)
+
+type ConnectionState uint8
+
+const (
+	CLOSED ConnectionState = iota
+	LISTEN
+	SYN_RECEIVED
+	ESTABLISHED
+	FIN_WAIT_1
+	FIN_WAIT_2
+	CLOSE_WAIT
+	CLOSING
+	LAST_ACK
+	TIME_WAIT
+)
+
+var stateNames = map[ConnectionState]string{
+	CLOSED:       "CLOSED",
+	LISTEN:       "LISTEN",
+	SYN_RECEIVED: "SYN-RECEIVED",
+	ESTABLISHED:  "ESTAB",
+	FIN_WAIT_1:   "FIN-WAIT-1",
+	FIN_WAIT_2:   "FIN-WAIT-2",
+	CLOSE_WAIT:   "CLOSE-WAIT",
+	CLOSING:      "CLOSING",
+	LAST_ACK:     "LAST-ACK",
+	TIME_WAIT:    "TIME-WAIT",
+}
+
+func (s ConnectionState) String() string {
+	if name, ok := stateNames[s]; ok {
+		return name
+	}
+	return fmt.Sprintf("ConnectionState(%d)", uint8(s))
+}
+
+// transitions lists the states reachable from each state. This is the RFC 9293
+// state diagram for a passive opener, plus CLOSED -> ESTAB for connections
+// rebuilt from a SYN cookie and X -> CLOSED for resets and timeouts.
+var transitions = map[ConnectionState][]ConnectionState{
+	CLOSED:       {LISTEN, ESTABLISHED},
+	LISTEN:       {SYN_RECEIVED, CLOSED},
+	SYN_RECEIVED: {ESTABLISHED, FIN_WAIT_1, CLOSED},
+	ESTABLISHED:  {FIN_WAIT_1, CLOSE_WAIT, CLOSED},
+	FIN_WAIT_1:   {FIN_WAIT_2, CLOSING, TIME_WAIT, CLOSED},
+	FIN_WAIT_2:   {TIME_WAIT, CLOSED},
+	CLOSE_WAIT:   {LAST_ACK, CLOSED},
+	CLOSING:      {TIME_WAIT, CLOSED},
+	LAST_ACK:     {CLOSED},
+	TIME_WAIT:    {CLOSED},
+}
+
+func (s ConnectionState) CanTransitionTo(next ConnectionState) bool {
+	for _, t := range transitions[s] {
+		if t == next {
+			return true
+		}
+	}
+	return false
+}
+
+// Synchronized reports whether the handshake has completed, i.e. the state is
+// past SYN-RECEIVED.
+func (s ConnectionState) Synchronized() bool {
+	return s != CLOSED && s != LISTEN && s != SYN_RECEIVED
+}
+
+// setState is the only place a connection's state changes. It must be called
+// with c.mu held.
+func (c *Connection) setState(next ConnectionState) error {
+	if !c.State.CanTransitionTo(next) {
+		return fmt.Errorf("illegal state transition %s -> %s", c.State, next)
+	}
+
+	c.logger().Info("state changed", "next", next.String())
+	c.emit(Event{Type: EventStateChanged, OldState: c.State, NewState: next})
+
+	c.State = next
+	return nil
+}
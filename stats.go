@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"sort"
+	"sync"
+)
+
+// DropCounters counts packets dropped before they reach a connection, by reason.
+type DropCounters struct {
+	mu     sync.Mutex
+	counts map[string]uint64
+}
+
+var drops DropCounters
+
+// Add counts a dropped packet and logs why, along with any attributes
+// identifying it.
+func (d *DropCounters) Add(logger *slog.Logger, reason string, args ...any) {
+	logger.Info("dropped packet", append([]any{"reason", reason}, args...)...)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.counts == nil {
+		d.counts = make(map[string]uint64)
+	}
+	d.counts[reason]++
+}
+
+func (d *DropCounters) Inspect() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	reasons := make([]string, 0, len(d.counts))
+	for reason := range d.counts {
+		reasons = append(reasons, reason)
+	}
+	sort.Strings(reasons)
+
+	fmt.Printf("dropped packets:\n")
+	for _, reason := range reasons {
+		fmt.Printf("%-24s %d\n", reason+":", d.counts[reason])
+	}
+}
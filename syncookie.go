@@ -0,0 +1,94 @@
+package main
+
+import (
+	"crypto/hmac"
+	crand "crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"time"
+)
+
+const (
+	// The cookie's timestamp ticks every 64 seconds, and cookies from the
+	// previous tick are still accepted
+	SYN_COOKIE_TICK    = 64 * time.Second
+	SYN_COOKIE_MAX_AGE = 1
+)
+
+// The MSS can't be stored anywhere without allocating state, so the cookie
+// carries an index into this table instead, rounding the peer's MSS down.
+var cookieMSS = []uint16{536, 1220, 1440, 1460}
+
+// SynCookies encodes handshake state into the ISN of a SYN-ACK, laid out as:
+//
+//	 0                   1                   2                   3
+//	 0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1
+//	+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+//	|   Time  | MSS |            MAC(quad, IRS, time, MSS)          |
+//	+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+//
+// so the final ACK of the handshake (which acknowledges ISN+1) carries
+// everything needed to rebuild the connection.
+type SynCookies struct {
+	secret [32]byte
+	now    func() time.Time
+}
+
+func NewSynCookies() (*SynCookies, error) {
+	s := &SynCookies{now: time.Now}
+	if _, err := crand.Read(s.secret[:]); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *SynCookies) tick() uint32 {
+	return uint32(s.now().UnixNano() / int64(SYN_COOKIE_TICK))
+}
+
+func (s *SynCookies) mac(quad Quad, irs SeqNum, tick, mssIndex uint32) uint32 {
+	mac := hmac.New(sha256.New, s.secret[:])
+	mac.Write(quad.SourceIP.AsSlice())
+	binary.Write(mac, binary.BigEndian, quad.SourcePort)
+	mac.Write(quad.DestinationIP.AsSlice())
+	binary.Write(mac, binary.BigEndian, quad.DestinationPort)
+	binary.Write(mac, binary.BigEndian, uint32(irs))
+	binary.Write(mac, binary.BigEndian, tick)
+	mac.Write([]byte{uint8(mssIndex)})
+	return binary.BigEndian.Uint32(mac.Sum(nil)) & 0xFFFFFF
+}
+
+// Make returns the ISN to use in a SYN-ACK answering a SYN with sequence number
+// irs and the given MSS option (0 if absent).
+func (s *SynCookies) Make(quad Quad, irs SeqNum, mss uint16) SeqNum {
+	mssIndex := uint32(0)
+	for i, m := range cookieMSS {
+		if m <= mss {
+			mssIndex = uint32(i)
+		}
+	}
+
+	tick := s.tick()
+	return SeqNum((tick&0x1F)<<27 | mssIndex<<24 | s.mac(quad, irs, tick, mssIndex))
+}
+
+// Check validates a cookie echoed back as ACK-1 on a segment with sequence
+// number IRS+1, returning the MSS it encodes.
+func (s *SynCookies) Check(quad Quad, irs SeqNum, cookie SeqNum) (mss uint16, ok bool) {
+	tick := s.tick()
+	age := (tick - uint32(cookie)>>27) & 0x1F
+	if age > SYN_COOKIE_MAX_AGE {
+		return 0, false
+	}
+
+	mssIndex := (uint32(cookie) >> 24) & 0x07
+	if mssIndex >= uint32(len(cookieMSS)) {
+		return 0, false
+	}
+
+	if s.mac(quad, irs, tick-age, mssIndex) != uint32(cookie)&0xFFFFFF {
+		return 0, false
+	}
+
+	return cookieMSS[mssIndex], true
+}
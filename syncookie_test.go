@@ -0,0 +1,81 @@
+package main
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+)
+
+var cookieQuad = Quad{
+	SourceIP: netip.MustParseAddr("10.0.0.1"), SourcePort: 40000,
+	DestinationIP: netip.MustParseAddr("10.0.0.2"), DestinationPort: 80,
+}
+
+// newTestSynCookies returns SynCookies whose clock is whatever *now says.
+func newTestSynCookies(t *testing.T, now *time.Time) *SynCookies {
+	s, err := NewSynCookies()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.now = func() time.Time { return *now }
+	return s
+}
+
+func TestSynCookieMSS(t *testing.T) {
+	now := time.Now()
+	s := newTestSynCookies(t, &now)
+
+	// The peer's MSS is rounded down to the nearest entry in cookieMSS
+	for mss, want := range map[uint16]uint16{0: 536, 536: 536, 1400: 1220, 1460: 1460, 9000: 1460} {
+		cookie := s.Make(cookieQuad, 1000, mss)
+		got, ok := s.Check(cookieQuad, 1000, cookie)
+		if !ok || got != want {
+			t.Errorf("MSS %d: Check = (%d, %v), want (%d, true)", mss, got, ok, want)
+		}
+	}
+}
+
+func TestSynCookieAge(t *testing.T) {
+	now := time.Unix(0, 0).Add(1000 * SYN_COOKIE_TICK)
+	s := newTestSynCookies(t, &now)
+	cookie := s.Make(cookieQuad, 1000, 1460)
+
+	now = now.Add(SYN_COOKIE_TICK)
+	if _, ok := s.Check(cookieQuad, 1000, cookie); !ok {
+		t.Errorf("cookie from the previous tick rejected")
+	}
+
+	now = now.Add(SYN_COOKIE_TICK)
+	if _, ok := s.Check(cookieQuad, 1000, cookie); ok {
+		t.Errorf("cookie two ticks old accepted")
+	}
+
+	// The timestamp is only 5 bits, so it comes round again after 32 ticks,
+	// but the MAC covers the full tick
+	now = now.Add(30 * SYN_COOKIE_TICK)
+	if _, ok := s.Check(cookieQuad, 1000, cookie); ok {
+		t.Errorf("cookie 32 ticks old accepted")
+	}
+}
+
+func TestSynCookieMismatch(t *testing.T) {
+	now := time.Now()
+	s := newTestSynCookies(t, &now)
+	cookie := s.Make(cookieQuad, 0xFFFFFFFF, 1460)
+
+	if _, ok := s.Check(cookieQuad, 0xFFFFFFFF, cookie); !ok {
+		t.Fatalf("cookie for IRS 0xFFFFFFFF rejected")
+	}
+
+	other := cookieQuad
+	other.SourcePort++
+	if _, ok := s.Check(other, 0xFFFFFFFF, cookie); ok {
+		t.Errorf("cookie accepted for a different quad")
+	}
+	if _, ok := s.Check(cookieQuad, 0, cookie); ok {
+		t.Errorf("cookie accepted with a different IRS")
+	}
+	if _, ok := s.Check(cookieQuad, 0xFFFFFFFF, cookie^1); ok {
+		t.Errorf("modified cookie accepted")
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+	"time"
+)
+
+// traceFlags abbreviates control bits the way tcpdump does, with "." for ACK.
+func traceFlags(bits uint8) string {
+	var b strings.Builder
+	for _, f := range []struct {
+		bit  uint8
+		name byte
+	}{{0x02, 'S'}, {0x01, 'F'}, {0x08, 'P'}, {0x04, 'R'}, {0x20, 'U'}, {0x10, '.'}} {
+		if bits&f.bit == f.bit {
+			b.WriteByte(f.name)
+		}
+	}
+	if b.Len() == 0 {
+		return "none"
+	}
+	return b.String()
+}
+
+// traceSegment prints one segment as a single line. Sequence numbers are
+// relative to the ISNs of conn's two directions, or absolute if there's no
+// connection. quad is from the peer's point of view, as everywhere else.
+func traceSegment(now time.Time, incoming bool, quad Quad, tcp *TCP, length int, conn *Connection, before, after ConnectionState) {
+	var seqBase, ackBase SeqNum
+	if conn != nil {
+		iss, irs := conn.initialSequenceNumbers()
+		seqBase, ackBase = iss, irs
+		if incoming {
+			seqBase, ackBase = irs, iss
+		}
+	}
+
+	direction := "out"
+	from := netip.AddrPortFrom(quad.DestinationIP, quad.DestinationPort)
+	to := netip.AddrPortFrom(quad.SourceIP, quad.SourcePort)
+	if incoming {
+		direction = "in "
+		from, to = to, from
+	}
+
+	seq := SeqNum(tcp.SequenceNumber).Diff(seqBase)
+	line := fmt.Sprintf("%s %s %s > %s [%s] seq %d", now.Format("15:04:05.000000"), direction, from, to, traceFlags(tcp.ControlBits), seq)
+	if length > 0 {
+		line += fmt.Sprintf(":%d", seq+uint32(length))
+	}
+	if tcp.ControlBits&0x10 == 0x10 {
+		line += fmt.Sprintf(" ack %d", SeqNum(tcp.AcknowledgmentNumber).Diff(ackBase))
+	}
+
+	fmt.Printf("%s win %d len %d %s -> %s\n", line, tcp.Window, length, before, after)
+}
+
+// initialSequenceNumbers returns ISS and IRS, for making trace output relative.
+func (c *Connection) initialSequenceNumbers() (iss, irs SeqNum) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.InitialSendSequenceNumber, c.InitialReceiveSequenceNumber
+}
+
+// traceOutgoing returns the state the last segment on the connection left it
+// in, and records the current one for the next segment. Outgoing segments
+// don't change the state themselves, but the call that produced them (e.g.
+// Close) may have.
+func (c *Connection) traceOutgoing() (before, after ConnectionState, trace bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	before, after = c.tracedState, c.State
+	c.tracedState = c.State
+	return before, after, c.Trace
+}
+
+func (c *Connection) SetTrace(trace bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.Trace = trace
+}
+
+func (c *Connection) getTrace() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.Trace
+}
+
+func (c *Connection) setTracedState(state ConnectionState) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.tracedState = state
+}
@@ -0,0 +1,412 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	UDP_HEADER_LENGTH = 8
+
+	// Datagrams queued on a socket that hasn't read them yet; more are dropped
+	UDP_RECEIVE_QUEUE = 64
+
+	// How much of the offending datagram to quote in an ICMP error: enough to
+	// fill the minimum MTU, as RFC 1812 §4.3.2.3 and RFC 4443 §2.4 suggest
+	ICMP_QUOTE_LENGTH   = 576 - 20 - 8
+	ICMPV6_QUOTE_LENGTH = IPV6_MIN_MTU - IPV6_HEADER_LENGTH - 8
+)
+
+var ErrInvalidUDPHeader = fmt.Errorf("failed to parse UDP header")
+var ErrPortInUse = fmt.Errorf("UDP port already bound")
+var ErrSocketClosed = fmt.Errorf("use of closed UDP socket")
+
+type UDP struct {
+	SourcePort, DestinationPort, Length, Checksum uint16
+}
+
+func parseUDPHeader(buf *bytes.Reader) (udp UDP, err error) {
+	/*
+	    0      7 8     15 16    23 24    31
+	   +--------+--------+--------+--------+
+	   |     Source      |   Destination   |
+	   |      Port       |      Port       |
+	   +--------+--------+--------+--------+
+	   |                 |                 |
+	   |     Length      |    Checksum     |
+	   +--------+--------+--------+--------+
+	**/
+
+	err = binary.Read(buf, binary.BigEndian, &udp.SourcePort)
+	if err != nil {
+		return
+	}
+
+	err = binary.Read(buf, binary.BigEndian, &udp.DestinationPort)
+	if err != nil {
+		return
+	}
+
+	err = binary.Read(buf, binary.BigEndian, &udp.Length)
+	if err != nil {
+		return
+	}
+
+	err = binary.Read(buf, binary.BigEndian, &udp.Checksum)
+	if err != nil {
+		return
+	}
+
+	if udp.Length < UDP_HEADER_LENGTH || int(udp.Length) > int(buf.Size()) {
+		return udp, ErrInvalidUDPHeader
+	}
+
+	return
+}
+
+// CalcChecksum computes the checksum over the datagram and the pseudo-header.
+// A computed checksum of zero is sent as all ones, since zero means "no
+// checksum" (RFC 768).
+func (u *UDP) CalcChecksum(source, destination netip.Addr, payload []byte) uint16 {
+	sum := pseudoHeaderSum(source, destination, 17, int(u.Length))
+	sum = add1sComplement(sum, u.SourcePort)
+	sum = add1sComplement(sum, u.DestinationPort)
+	sum = add1sComplement(sum, u.Length)
+	sum = add1sComplementBytes(sum, payload)
+
+	if ^sum == 0 {
+		return 0xFFFF
+	}
+	return ^sum
+}
+
+// Serialize sets Length and Checksum and encodes the datagram.
+func (u *UDP) Serialize(source, destination netip.Addr, payload []byte) *bytes.Buffer {
+	buf := bytes.NewBuffer([]byte{})
+
+	u.Length = uint16(UDP_HEADER_LENGTH + len(payload))
+	u.Checksum = u.CalcChecksum(source, destination, payload)
+
+	binary.Write(buf, binary.BigEndian, u.SourcePort)
+	binary.Write(buf, binary.BigEndian, u.DestinationPort)
+	binary.Write(buf, binary.BigEndian, u.Length)
+	binary.Write(buf, binary.BigEndian, u.Checksum)
+
+	buf.Write(payload)
+
+	return buf
+}
+
+// verifyUDPChecksum checks the checksum of a raw datagram. The checksum is
+// optional over IPv4, but mandatory over IPv6 (RFC 8200 §8.1).
+func verifyUDPChecksum(source, destination netip.Addr, datagram []byte) bool {
+	if binary.BigEndian.Uint16(datagram[6:]) == 0 {
+		return source.Is4()
+	}
+
+	sum := pseudoHeaderSum(source, destination, 17, len(datagram))
+	sum = add1sComplementBytes(sum, datagram)
+
+	return sum == 0xFFFF
+}
+
+type udpDatagram struct {
+	From    netip.AddrPort
+	Payload []byte
+}
+
+// UDPConn is a socket bound to a local UDP port. It implements net.PacketConn,
+// for both IPv4 and IPv6 peers.
+type UDPConn struct {
+	endpoints *UDPEndpoints
+	Port      uint16
+
+	queue  chan udpDatagram
+	closed chan struct{}
+	once   sync.Once
+
+	mu           sync.Mutex
+	readDeadline time.Time
+
+	// Closed and replaced whenever the read deadline changes, to wake up
+	// blocked readers
+	deadlineChanged chan struct{}
+}
+
+var _ net.PacketConn = (*UDPConn)(nil)
+
+// ReadFrom blocks until a datagram arrives, copying its payload into p. As with
+// net.PacketConn, anything that doesn't fit in p is discarded, and a deadline
+// that passes returns os.ErrDeadlineExceeded.
+func (u *UDPConn) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
+	for {
+		u.mu.Lock()
+		deadline, changed := u.readDeadline, u.deadlineChanged
+		u.mu.Unlock()
+
+		var timeout <-chan time.Time
+		var timer *time.Timer
+		if !deadline.IsZero() {
+			timer = time.NewTimer(time.Until(deadline))
+			timeout = timer.C
+		}
+
+		select {
+		case d := <-u.queue:
+			stopTimer(timer)
+			return copy(p, d.Payload), net.UDPAddrFromAddrPort(d.From), nil
+		case <-u.closed:
+			stopTimer(timer)
+			return 0, nil, ErrSocketClosed
+		case <-timeout:
+			return 0, nil, os.ErrDeadlineExceeded
+		case <-changed:
+			// Start again with the new deadline
+			stopTimer(timer)
+		}
+	}
+}
+
+func stopTimer(timer *time.Timer) {
+	if timer != nil {
+		timer.Stop()
+	}
+}
+
+// WriteTo sends p in a single datagram to addr, which must be a *net.UDPAddr.
+func (u *UDPConn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
+	select {
+	case <-u.closed:
+		return 0, ErrSocketClosed
+	default:
+	}
+
+	udpAddr, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return 0, fmt.Errorf("not a UDP address: %s", addr)
+	}
+
+	to := udpAddr.AddrPort()
+	if !to.Addr().IsValid() {
+		return 0, fmt.Errorf("no destination address: %s", addr)
+	}
+	to = netip.AddrPortFrom(to.Addr().Unmap(), to.Port())
+
+	err = u.endpoints.send(u.Port, to, p)
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (u *UDPConn) Close() error {
+	u.once.Do(func() {
+		u.endpoints.unbind(u.Port)
+		close(u.closed)
+	})
+	return nil
+}
+
+// LocalAddr returns our IPv4 address and the port. The socket also receives
+// datagrams sent to our IPv6 address.
+func (u *UDPConn) LocalAddr() net.Addr {
+	return net.UDPAddrFromAddrPort(netip.AddrPortFrom(u.endpoints.LocalIP, u.Port))
+}
+
+func (u *UDPConn) SetDeadline(t time.Time) error {
+	return u.SetReadDeadline(t)
+}
+
+// SetReadDeadline applies to calls to ReadFrom that are already blocked as
+// well as future ones.
+func (u *UDPConn) SetReadDeadline(t time.Time) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	u.readDeadline = t
+	close(u.deadlineChanged)
+	u.deadlineChanged = make(chan struct{})
+	return nil
+}
+
+// SetWriteDeadline is a no-op: writes never block.
+func (u *UDPConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+// UDPEndpoints is the table of bound UDP ports.
+type UDPEndpoints struct {
+	mu    sync.Mutex
+	ports map[uint16]*UDPConn
+
+	out                *IPOutput
+	LocalIP, LocalIPv6 netip.Addr
+
+	// Our IPv4 subnet, whose broadcast address we never send errors for
+	Subnet netip.Prefix
+}
+
+func NewUDPEndpoints(out *IPOutput, subnet netip.Prefix, localIPv6 netip.Addr) *UDPEndpoints {
+	return &UDPEndpoints{
+		ports:     make(map[uint16]*UDPConn),
+		out:       out,
+		LocalIP:   subnet.Addr(),
+		LocalIPv6: localIPv6,
+		Subnet:    subnet,
+	}
+}
+
+// Bind opens a socket on a local port, for datagrams to any of our addresses.
+func (e *UDPEndpoints) Bind(port uint16) (*UDPConn, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if _, ok := e.ports[port]; ok {
+		return nil, ErrPortInUse
+	}
+
+	conn := &UDPConn{
+		endpoints: e,
+		Port:      port,
+		queue:     make(chan udpDatagram, UDP_RECEIVE_QUEUE),
+		closed:    make(chan struct{}),
+
+		deadlineChanged: make(chan struct{}),
+	}
+	e.ports[port] = conn
+	return conn, nil
+}
+
+func (e *UDPEndpoints) Get(port uint16) (*UDPConn, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	conn, ok := e.ports[port]
+	if !ok {
+		return nil, fmt.Errorf("UDP port %d isn't bound", port)
+	}
+	return conn, nil
+}
+
+func (e *UDPEndpoints) unbind(port uint16) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	delete(e.ports, port)
+}
+
+func (e *UDPEndpoints) send(port uint16, to netip.AddrPort, payload []byte) error {
+	source := e.LocalIP
+	if to.Addr().Is6() {
+		source = e.LocalIPv6
+	}
+
+	udp := UDP{SourcePort: port, DestinationPort: to.Port()}
+	datagram := udp.Serialize(source, to.Addr(), payload).Bytes()
+
+	if to.Addr().Is6() {
+		return e.out.SendIPv6(IPv6{
+			HopLimit:           DEFAULT_TTL,
+			NextHeader:         17,
+			SourceAddress:      source,
+			DestinationAddress: to.Addr(),
+		}, datagram)
+	}
+
+	return e.out.Send(IP{
+		TimeToLive:         DEFAULT_TTL,
+		Protocol:           17,
+		SourceAddress:      addrToUint32(source),
+		DestinationAddress: addrToUint32(to.Addr()),
+	}, datagram)
+}
+
+// Deliver queues a datagram for the socket bound to its destination port. It
+// returns false if no socket is bound there.
+func (e *UDPEndpoints) Deliver(source netip.Addr, udp *UDP, payload []byte) bool {
+	e.mu.Lock()
+	conn, ok := e.ports[udp.DestinationPort]
+	e.mu.Unlock()
+
+	if !ok {
+		return false
+	}
+
+	select {
+	case conn.queue <- udpDatagram{From: netip.AddrPortFrom(source, udp.SourcePort), Payload: append([]byte{}, payload...)}:
+	default:
+		drops.Add(parseLog, "UDP receive queue full", "src", netip.AddrPortFrom(source, udp.SourcePort), "port", udp.DestinationPort)
+	}
+	return true
+}
+
+// portUnreachable answers a datagram for an unbound port with an ICMP or
+// ICMPv6 port unreachable error quoting it. Errors are never sent in response
+// to multicast or broadcast datagrams (RFC 1122 §3.2.2).
+func (e *UDPEndpoints) portUnreachable(source, destination netip.Addr, quote []byte) {
+	limitedBroadcast := netip.AddrFrom4([4]byte{255, 255, 255, 255})
+	if destination.IsMulticast() || destination == limitedBroadcast || destination == broadcastAddress(e.Subnet) {
+		return
+	}
+
+	icmp := ICMP{Type: ICMP_DESTINATION_UNREACHABLE, Code: ICMP_PORT_UNREACHABLE}
+	limit := ICMP_QUOTE_LENGTH
+	if destination.Is6() {
+		icmp = ICMP{Type: ICMPV6_DESTINATION_UNREACHABLE, Code: ICMPV6_PORT_UNREACHABLE}
+		limit = ICMPV6_QUOTE_LENGTH
+	}
+
+	if len(quote) > limit {
+		quote = quote[:limit]
+	}
+
+	err := sendICMP(e.out, destination, source, DEFAULT_TTL, icmp, quote)
+	if err != nil {
+		linkLog.Error("failed to send port unreachable", "dst", source, "err", err)
+	}
+}
+
+// handleUDP delivers a datagram from either address family. quote is the
+// datagram with its IP header, for use in an ICMP error.
+func handleUDP(source, destination netip.Addr, datagram, quote []byte, connections *Connections, verifyChecksums bool) {
+	reader := bytes.NewReader(datagram)
+	udp, err := parseUDPHeader(reader)
+	if err != nil {
+		drops.Add(parseLog, ErrInvalidUDPHeader.Error(), "src", source)
+		return
+	}
+
+	// Anything past Length is padding
+	datagram = datagram[:udp.Length]
+
+	if verifyChecksums && !verifyUDPChecksum(source, destination, datagram) {
+		drops.Add(parseLog, "bad UDP checksum", "src", source)
+		return
+	}
+
+	if !connections.udp.Deliver(source, &udp, datagram[UDP_HEADER_LENGTH:]) {
+		drops.Add(parseLog, "UDP port unreachable", "src", netip.AddrPortFrom(source, udp.SourcePort), "port", udp.DestinationPort)
+		connections.udp.portUnreachable(source, destination, quote)
+	}
+}
+
+// printDatagrams copies datagrams received on a socket to stdout until it's
+// closed.
+func printDatagrams(conn *UDPConn) {
+	buf := make([]byte, IP_MAX_DATAGRAM_LENGTH)
+	for {
+		n, from, err := conn.ReadFrom(buf)
+		if err != nil {
+			replLog.Info("stopped reading from UDP socket", "port", conn.Port, "err", err)
+			return
+		}
+		replLog.Info("datagram received", "port", conn.Port, "bytes", n, "from", from)
+		os.Stdout.Write(buf[:n])
+	}
+}
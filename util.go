@@ -1,11 +1,52 @@
 package main
 
-import "fmt"
+import (
+	"fmt"
+	"net/netip"
+)
 
 func formatIPAddress(addr uint32) string {
 	return fmt.Sprintf("%d.%d.%d.%d", addr>>24, (addr>>16)&0xFF, (addr>>8)&0xFF, addr&0xFF)
 }
 
+func addrFromUint32(addr uint32) netip.Addr {
+	return netip.AddrFrom4([4]byte{byte(addr >> 24), byte(addr >> 16), byte(addr >> 8), byte(addr)})
+}
+
+// broadcastAddress returns the directed broadcast address of an IPv4 subnet,
+// or the zero Addr if it doesn't have one: a /32, or a /31 (RFC 3021).
+func broadcastAddress(subnet netip.Prefix) netip.Addr {
+	if !subnet.Addr().Is4() || subnet.Bits() >= 31 {
+		return netip.Addr{}
+	}
+	return addrFromUint32(addrToUint32(subnet.Addr()) | (1<<(32-subnet.Bits()) - 1))
+}
+
+// addrToUint32 returns an IPv4 address in the form used by the IP header.
+func addrToUint32(addr netip.Addr) uint32 {
+	b := addr.As4()
+	return uint32(b[0])<<24 | uint32(b[1])<<16 | uint32(b[2])<<8 | uint32(b[3])
+}
+
+// pseudoHeaderSum is the sum of the pseudo-header that TCP and UDP checksums
+// cover: RFC 9293 §3.1 for IPv4, RFC 8200 §8.1 for IPv6.
+func pseudoHeaderSum(source, destination netip.Addr, protocol uint8, length int) uint16 {
+	sum := uint16(0)
+	sum = add1sComplementBytes(sum, source.AsSlice())
+	sum = add1sComplementBytes(sum, destination.AsSlice())
+
+	if source.Is4() {
+		sum = add1sComplement(sum, uint16(protocol))
+		sum = add1sComplement(sum, uint16(length))
+	} else {
+		sum = add1sComplement(sum, uint16(length>>16))
+		sum = add1sComplement(sum, uint16(length&0xFFFF))
+		sum = add1sComplement(sum, uint16(protocol))
+	}
+
+	return sum
+}
+
 func add1sComplement(x, y uint16) uint16 {
 	temp := int32(x) + int32(y)
 
@@ -14,3 +55,17 @@ func add1sComplement(x, y uint16) uint16 {
 
 	return sum
 }
+
+// add1sComplementBytes adds data to sum as a sequence of big-endian 16-bit
+// words, padding an odd trailing byte with zero.
+func add1sComplementBytes(sum uint16, data []byte) uint16 {
+	for i := 0; i+1 < len(data); i += 2 {
+		sum = add1sComplement(sum, uint16(data[i])<<8+uint16(data[i+1]))
+	}
+
+	if len(data)%2 != 0 {
+		sum = add1sComplement(sum, uint16(data[len(data)-1])<<8)
+	}
+
+	return sum
+}